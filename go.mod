@@ -7,6 +7,6 @@ toolchain go1.23.5
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/zmb3/spotify v1.3.0
+	golang.org/x/crypto v0.36.0
+	golang.org/x/oauth2 v0.28.0
 )
-
-require golang.org/x/oauth2 v0.28.0 // indirect
@@ -1,24 +1,77 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/mikev/spotify-analysis/pkg/changes"
 	"github.com/mikev/spotify-analysis/pkg/config"
 	"github.com/mikev/spotify-analysis/pkg/logger"
+	"github.com/mikev/spotify-analysis/pkg/match"
 	"github.com/mikev/spotify-analysis/pkg/output"
 	"github.com/mikev/spotify-analysis/pkg/processor"
 	"github.com/mikev/spotify-analysis/pkg/spotify"
 )
 
+// outputDir is the directory CSV files are written to
+const outputDir = "playlists"
+
+// exitCancelled is the exit status of a run stopped by a signal, as used by shells for SIGINT
+const exitCancelled = 130
+
+// clients tracks the Spotify clients that need cleanup on exit
+var (
+	clientsMu sync.Mutex
+	clients   []*spotify.Client
+)
+
 func main() {
+	// Set up signal handling for graceful shutdown: the first signal cancels the
+	// run, a second one exits immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Println("\nReceived shutdown signal. Stopping...")
+		cancel()
+		<-sigChan
+		fmt.Println("\nReceived second shutdown signal. Cleaning up...")
+		cleanupClients()
+		logger.Close()
+		os.Exit(exitCancelled)
+	}()
+
+	err := run(ctx)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		log.Printf("Run cancelled: %v", err)
+		logger.Close()
+		os.Exit(exitCancelled)
+	case err != nil:
+		log.Printf("%v", err)
+		logger.Close()
+		os.Exit(1)
+	}
+	logger.Close()
+
+	fmt.Println("All playlists have been processed!")
+}
+
+// run loads the configuration and analyzes the playlists of every configured account
+func run(ctx context.Context) error {
 	// Load configuration
 	cfg, err := config.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		return fmt.Errorf("failed to load config: %v", err)
 	}
 
 	// Initialize logger
@@ -28,49 +81,201 @@ func main() {
 		KeepFiles:  cfg.LogKeepFiles,
 	}
 	if err := logger.InitLogger(logCfg); err != nil {
-		log.Fatalf("Failed to initialize logger: %v", err)
+		return fmt.Errorf("failed to initialize logger: %v", err)
+	}
+
+	// Ensure client cleanup on exit
+	defer cleanupClients()
+
+	// Single account: write directly to the output directory
+	if len(cfg.Accounts) == 0 {
+		_, err := processAccount(ctx, cfg, outputDir)
+		return err
+	}
+
+	// Multiple accounts: one output directory per account plus a combined report
+	var results []processor.AccountTracks
+	for _, name := range cfg.Accounts {
+		log.Printf("Processing account %s...", name)
+		tracks, err := processAccount(ctx, cfg.ForAccount(name), filepath.Join(outputDir, name))
+		if err != nil {
+			return fmt.Errorf("account %s: %v", name, err)
+		}
+		results = append(results, processor.AccountTracks{Account: name, Tracks: tracks})
 	}
 
+	writer, err := output.NewCSVWriter(outputDir, cfg.OverwriteFiles)
+	if err != nil {
+		return fmt.Errorf("failed to initialize CSV writer: %v", err)
+	}
+	report := processor.CombineAccounts(cfg, results)
+	if err := writer.WriteCombinedReport(ctx, report); err != nil {
+		return fmt.Errorf("failed to write combined report: %v", err)
+	}
+	log.Printf("Found %d tracks missing from at least one account's top tracks playlists", len(report))
+
+	return nil
+}
+
+// processAccount analyzes the playlists of one account and writes its CSV files to dir
+func processAccount(ctx context.Context, cfg *config.Config, dir string) (map[string][]processor.TrackData, error) {
 	// Initialize Spotify client
-	client, err := spotify.NewClient(cfg)
+	client, err := spotify.NewClient(ctx, cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize Spotify client: %v", err)
+		return nil, fmt.Errorf("failed to initialize Spotify client: %v", err)
 	}
-	// Ensure client cleanup on exit
-	defer client.Cleanup()
+	clientsMu.Lock()
+	clients = append(clients, client)
+	clientsMu.Unlock()
 
-	// Set up signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Println("\nReceived shutdown signal. Cleaning up...")
-		client.Cleanup()
-		os.Exit(0)
-	}()
+	// Pick up the decisions made in the previous run's match review
+	if cfg.FuzzyMatch {
+		if err := importMatchReview(cfg, dir); err != nil {
+			return nil, err
+		}
+	}
 
 	// Initialize playlist processor
 	processor, err := processor.NewPlaylistProcessor(client.Client, cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize playlist processor: %v", err)
+		return nil, fmt.Errorf("failed to initialize playlist processor: %v", err)
 	}
 
 	// Process playlists
-	tracks, err := processor.ProcessPlaylists()
+	result, err := processor.ProcessPlaylists(ctx)
+	stats := client.RetryStats()
+	log.Printf("API requests: %d, retries: %d (rate limited: %d, server errors: %d, network errors: %d), failed: %d, waited: %s",
+		stats.Requests, stats.Retries, stats.RateLimited, stats.ServerErrors, stats.NetworkErrors, stats.Failures, stats.Waited)
 	if err != nil {
-		log.Fatalf("Failed to process playlists: %v", err)
+		return nil, fmt.Errorf("failed to process playlists: %v", err)
 	}
 
 	// Initialize CSV writer
-	writer, err := output.NewCSVWriter("playlists", cfg.OverwriteFiles)
+	writer, err := output.NewCSVWriter(dir, cfg.OverwriteFiles)
 	if err != nil {
-		log.Fatalf("Failed to initialize CSV writer: %v", err)
+		return nil, fmt.Errorf("failed to initialize CSV writer: %v", err)
 	}
 
 	// Write tracks to CSV files
-	if err := writer.WriteTracks(tracks); err != nil {
-		log.Fatalf("Failed to write tracks to CSV: %v", err)
+	if err := writer.WriteTracks(ctx, result.Tracks); err != nil {
+		return nil, fmt.Errorf("failed to write tracks to CSV: %v", err)
+	}
+	if err := writer.WritePlaylistSummary(ctx, result.Summaries); err != nil {
+		return nil, fmt.Errorf("failed to write playlist summary to CSV: %v", err)
 	}
 
-	fmt.Println("All playlists have been processed!")
+	// Report playlists that still failed after retrying
+	if err := writer.WriteFailedPlaylists(ctx, result.Failed); err != nil {
+		return nil, fmt.Errorf("failed to write failed playlists to CSV: %v", err)
+	}
+	if len(result.Failed) > 0 {
+		fmt.Printf("Warning: %d playlists could not be fetched; see %s\n", len(result.Failed), filepath.Join(dir, "failed_playlists.csv"))
+	}
+
+	// Report malformed track data
+	if err := writer.WriteDataQuality(ctx, result.DataIssues); err != nil {
+		return nil, fmt.Errorf("failed to write data quality report to CSV: %v", err)
+	}
+	if len(result.DataIssues) > 0 {
+		fmt.Printf("Warning: %d tracks have malformed data; see %s\n", len(result.DataIssues), filepath.Join(dir, "data_quality.csv"))
+	}
+
+	// List the possible matches to review, replacing the previous list
+	if cfg.FuzzyMatch {
+		if err := writer.WriteMatchReview(ctx, result.PossibleMatches); err != nil {
+			return nil, fmt.Errorf("failed to write match review to CSV: %v", err)
+		}
+		if len(result.PossibleMatches) > 0 {
+			fmt.Printf("%d possible matches need review; see %s\n", len(result.PossibleMatches), filepath.Join(dir, output.MatchReviewFile))
+		}
+	}
+
+	// Report the tracks Spotify says were played most that the playlists miss
+	if cfg.ListeningReport {
+		if err := writer.WriteListeningReport(ctx, result.Listening); err != nil {
+			return nil, fmt.Errorf("failed to write listening report to CSV: %v", err)
+		}
+		if len(result.Listening) > 0 {
+			fmt.Printf("%d heavily played tracks are missing from the top tracks playlists; see %s\n", len(result.Listening), filepath.Join(dir, "listening_report.csv"))
+		} else {
+			fmt.Println("No heavily played tracks are missing from the top tracks playlists")
+		}
+	}
+
+	// Rank the candidates for each year's top tracks playlist
+	if cfg.Suggestions {
+		files, err := writer.WriteSuggestions(ctx, result.Suggestions, cfg.StreamingHistoryDir != "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to write suggestions to CSV: %v", err)
+		}
+		if len(files) > 0 {
+			fmt.Printf("Suggestions for the top tracks playlists of %d years written to %s in %s\n", len(files), strings.Join(files, ", "), dir)
+		}
+	}
+
+	// Report what changed since the previous run and save this one
+	if cfg.HistoryDir != "" {
+		if err := reportChanges(ctx, cfg, writer, result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result.Tracks, nil
+}
+
+// reportChanges writes the changes since the previous run, if any, and saves this run's results
+func reportChanges(ctx context.Context, cfg *config.Config, writer *output.CSVWriter, result *processor.Result) error {
+	store := changes.NewStore(cfg.HistoryDir, cfg.HistoryKeepRuns)
+	previous, previousPath, err := store.Latest()
+	if err != nil {
+		return fmt.Errorf("failed to load previous run: %v", err)
+	}
+
+	snapshot := changes.NewSnapshot(result, previous)
+	if previous == nil {
+		log.Println("No previous run found; changes will be reported from the next run")
+	} else {
+		list := changes.Compare(previous, snapshot)
+		if err := writer.WriteChanges(ctx, list); err != nil {
+			return fmt.Errorf("failed to write changes to CSV: %v", err)
+		}
+		log.Printf("Found %d changes since the run saved in %s", len(list), previousPath)
+	}
+
+	path, err := store.Save(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to save run: %v", err)
+	}
+	log.Printf("Saved run to %s", path)
+	return nil
+}
+
+// importMatchReview saves the decisions filled in the match review file of the previous run
+func importMatchReview(cfg *config.Config, dir string) error {
+	decisions, err := match.LoadDecisions(cfg.MatchDecisionsFile)
+	if err != nil {
+		return err
+	}
+	imported, err := decisions.ImportReview(filepath.Join(dir, output.MatchReviewFile))
+	if err != nil {
+		return err
+	}
+	if imported == 0 {
+		return nil
+	}
+	if err := decisions.Save(); err != nil {
+		return err
+	}
+	log.Printf("Imported %d match decisions into %s", imported, cfg.MatchDecisionsFile)
+	return nil
+}
+
+// cleanupClients cleans up every Spotify client created so far
+func cleanupClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, client := range clients {
+		client.Cleanup()
+	}
+	clients = nil
 }
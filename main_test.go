@@ -0,0 +1,692 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/logger"
+	"github.com/mikev/spotify-analysis/pkg/spotify"
+	"github.com/mikev/spotify-analysis/pkg/spotifytest"
+	"golang.org/x/oauth2"
+)
+
+// setupRun starts a fake Spotify API serving the fixture and prepares a working
+// directory with a .env pointing at it and an expired saved token, so run()
+// refreshes the token instead of starting an interactive login
+func setupRun(t *testing.T, fixture string, env map[string]string) *spotifytest.Server {
+	t.Helper()
+
+	data, err := spotifytest.LoadFixture(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := spotifytest.NewServer(data)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	t.Cleanup(func() { logger.Close() })
+
+	settings := map[string]string{
+		"SPOTIFY_CLIENT_ID":               "test-client",
+		"SPOTIFY_CLIENT_SECRET":           "test-secret",
+		"SPOTIFY_REDIRECT_URI":            "http://localhost:8081/callback",
+		"SPOTIFY_PORT":                    "8081",
+		"SPOTIFY_TOP_TRACKS_PATTERN":      "my top tracks of",
+		"SPOTIFY_START_YEAR":              "2020",
+		"SPOTIFY_END_YEAR":                "2025",
+		"SPOTIFY_INCLUDE_OTHER_PLAYLISTS": "true",
+		"SPOTIFY_OVERWRITE_FILES":         "true",
+		"SPOTIFY_LOG_FILE":                "logs/test.log",
+		"SPOTIFY_TOKEN_FILE":              "tokens/token.json",
+		"SPOTIFY_API_URL":                 server.URL,
+		"SPOTIFY_ACCOUNTS_URL":            server.URL,
+		"SPOTIFY_WORKERS":                 "3",
+		"SPOTIFY_REQUESTS_PER_SECOND":     "0",
+	}
+	for key, value := range env {
+		settings[key] = value
+	}
+
+	// godotenv does not override variables that are already set, so set them
+	// directly as well; t.Setenv restores the environment after the test
+	var lines []string
+	for key, value := range settings {
+		t.Setenv(key, value)
+		lines = append(lines, fmt.Sprintf("%s=%s", key, value))
+	}
+	if err := os.WriteFile(".env", []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := &oauth2.Token{
+		AccessToken:  "expired-access-token",
+		TokenType:    "Bearer",
+		RefreshToken: spotifytest.RefreshToken,
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	if err := spotify.NewTokenStore("tokens/token.json", "").Save(expired); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+// readCSV reads a generated CSV file, dropping the UTF-8 BOM
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff"))).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	return rows
+}
+
+// column returns the index of a column in the header row
+func column(t *testing.T, rows [][]string, name string) int {
+	t.Helper()
+	for i, header := range rows[0] {
+		if header == name {
+			return i
+		}
+	}
+	t.Fatalf("column %q not found in %v", name, rows[0])
+	return -1
+}
+
+// flagged returns the tracks marked as missing from the top tracks playlists, keyed by
+// playlist and track name, with the other top tracks playlists they were found in
+func flagged(t *testing.T, rows [][]string) map[string]string {
+	t.Helper()
+	flag := column(t, rows, "NotInTopTrackPlaylist")
+	foundIn := column(t, rows, "Found In Top Tracks Playlist")
+	result := make(map[string]string)
+	for _, row := range rows[1:] {
+		if row[flag] == "TRUE" {
+			result[row[0]+"/"+row[1]] = row[foundIn]
+		}
+	}
+	return result
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	// Availability is only reported for a market
+	server := setupRun(t, "e2e_fixture.json", map[string]string{"SPOTIFY_MARKET": "from_token"})
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	if got := server.Requests("/api/token"); got != 1 {
+		t.Errorf("expected 1 token refresh, got %d", got)
+	}
+	// Playlists are listed once, not once for the top tracks and again for processing
+	if got := server.Requests("/v1/me/playlists"); got != 1 {
+		t.Errorf("expected playlists to be listed once, got %d requests", got)
+	}
+	// The library is only read when enabled
+	if got := server.Requests("/v1/me/tracks") + server.Requests("/v1/me/albums"); got != 0 {
+		t.Errorf("expected the library not to be fetched, got %d requests", got)
+	}
+	if got := server.Requests("/v1/me/top/tracks") + server.Requests("/v1/me/player/recently-played"); got != 0 {
+		t.Errorf("expected no listening history requests, got %d", got)
+	}
+	// 101 tracks need two pages
+	if got := server.Requests("/v1/playlists/pl-bulk/tracks"); got < 2 {
+		t.Errorf("expected paginated requests for pl-bulk, got %d", got)
+	}
+
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	wantHeader := []string{"Playlist", "Track Name", "Artist(s)", "Album", "Item Type", "Availability", "Release Date", "Release Date Precision", "Release Year", "Year Source", "NotInTopTrackPlaylist", "Found In Top Tracks Playlist", "Match Strategy", "Match Score", "Play Count", "Minutes Played"}
+	if strings.Join(user[0], ",") != strings.Join(wantHeader, ",") {
+		t.Errorf("unexpected header: %v", user[0])
+	}
+	if got := len(user) - 1; got != 118 {
+		t.Errorf("expected 118 user tracks, got %d", got)
+	}
+
+	// Rows follow the playlist order regardless of which worker finished first
+	var order []string
+	for _, row := range user[1:] {
+		if len(order) == 0 || order[len(order)-1] != row[0] {
+			order = append(order, row[0])
+		}
+	}
+	wantOrder := []string{"My Top Tracks of 2021", "My Top Tracks of 2022", "Road Trip", "Bulk 2024"}
+	if strings.Join(order, "|") != strings.Join(wantOrder, "|") {
+		t.Errorf("unexpected playlist order: %v", order)
+	}
+
+	userFlags := flagged(t, user)
+	if foundIn, ok := userFlags["Road Trip/Missing Piece"]; !ok || foundIn != "" {
+		t.Errorf("expected Missing Piece to be flagged and found in no top tracks playlist, got %v %q", ok, foundIn)
+	}
+	// A 2021 track only in the 2022 top tracks playlist is still missing from 2021's
+	if foundIn := userFlags["Road Trip/Late Bloomer"]; foundIn != "My Top Tracks of 2022" {
+		t.Errorf("expected Late Bloomer to be flagged and found in the 2022 playlist, got %q", foundIn)
+	}
+	for _, name := range []string{"Road Trip/Golden Hour", "Road Trip/Golden Hour - 2021 Remaster", "Road Trip/Night Drive", "Road Trip/Old Favourite"} {
+		if _, ok := userFlags[name]; ok {
+			t.Errorf("did not expect %s to be flagged", name)
+		}
+	}
+	// Other releases of a top track match by ISRC or by title and artist, not by ID
+	strategy := column(t, user, "Match Strategy")
+	strategies := make(map[string]string)
+	for _, row := range user[1:] {
+		if row[0] == "Road Trip" {
+			strategies[row[1]+"/"+row[3]] = row[strategy]
+		}
+	}
+	wantStrategies := map[string]string{
+		"Golden Hour/First Light":                          "id",
+		"Golden Hour - 2021 Remaster/First Light (Deluxe)": "title_artist",
+		"Night Drive/Neon":                                 "id",
+		"Night Drive/Night Drive":                          "isrc",
+		"Missing Piece/Gaps":                               "",
+		"Late Bloomer/Seasons":                             "id",
+	}
+	for track, want := range wantStrategies {
+		if got := strategies[track]; got != want {
+			t.Errorf("expected match strategy %q for %s, got %q", want, track, got)
+		}
+	}
+	if got := len(userFlags); got != 106 {
+		t.Errorf("expected 106 flagged user tracks, got %d", got)
+	}
+
+	// A placeholder release date leaves the year blank and is reported instead of flagged
+	precision := column(t, user, "Release Date Precision")
+	for _, row := range user[1:] {
+		if row[1] == "Golden Hour" && row[precision] != "day" {
+			t.Errorf("expected Golden Hour to have day precision, got %q", row[precision])
+		}
+	}
+	if _, ok := userFlags["Road Trip/Lost Tapes"]; ok {
+		t.Error("did not expect Lost Tapes to be flagged")
+	}
+	issues := readCSV(t, filepath.Join("playlists", "data_quality.csv"))
+	if len(issues) != 2 || issues[1][1] != "Lost Tapes" || issues[1][3] != "Release Date" || issues[1][4] != "0000" {
+		t.Errorf("unexpected data quality report: %v", issues)
+	}
+
+	// Episodes, local files and items Spotify no longer has are listed but never marked
+	itemType, availability := column(t, user, "Item Type"), column(t, user, "Availability")
+	wantItems := map[string]string{
+		"Garage Demo":       "local/available",
+		"Road Trip Stories": "episode/available",
+		"":                  "track/unavailable",
+		"Far Away":          "track/region_restricted",
+		"Night Drive":       "track/available",
+	}
+	for _, row := range user[1:] {
+		if want, ok := wantItems[row[1]]; ok && row[0] == "Road Trip" {
+			if got := row[itemType] + "/" + row[availability]; got != want {
+				t.Errorf("expected %q to be %s, got %s", row[1], want, got)
+			}
+		}
+	}
+	summary := readCSV(t, filepath.Join("playlists", "playlist_summary.csv"))
+	wantSummary := "Road Trip,testuser,14,12,1,1,1,1"
+	if len(summary) != 6 || strings.Join(summary[3], ",") != wantSummary {
+		t.Errorf("expected the Road Trip summary %q, got %v", wantSummary, summary)
+	}
+
+	other := readCSV(t, filepath.Join("playlists", "other_playlists.csv"))
+	if len(other) != 2 || other[1][0] != "Friend’s Mix" || other[1][column(t, other, "NotInTopTrackPlaylist")] != "TRUE" {
+		t.Errorf("unexpected other playlists output: %v", other)
+	}
+
+	// The refreshed token is saved for the next run
+	tok, err := spotify.NewTokenStore("tokens/token.json", "").Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != spotifytest.AccessToken {
+		t.Errorf("expected refreshed token to be saved, got %q", tok.AccessToken)
+	}
+}
+
+func TestRunAccounts(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{"SPOTIFY_ACCOUNTS": "alice,bob"})
+	// Each account logs in with its own saved token
+	token, err := os.ReadFile(filepath.Join("tokens", "token.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := os.WriteFile(filepath.Join("tokens", "token-"+name+".json"), token, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if got := server.Requests("/api/token"); got != 2 {
+		t.Errorf("expected one token refresh per account, got %d", got)
+	}
+
+	// Every account gets its own output files and run history
+	missing := make(map[string]bool)
+	for _, name := range []string{"alice", "bob"} {
+		for _, file := range []string{"user_playlists.csv", "other_playlists.csv", "playlist_summary.csv"} {
+			if _, err := os.Stat(filepath.Join("playlists", name, file)); err != nil {
+				t.Errorf("expected %s for %s: %v", file, name, err)
+			}
+		}
+		if runs, _ := filepath.Glob(filepath.Join("history", name, "run-*.json")); len(runs) != 1 {
+			t.Errorf("expected one saved run for %s, got %v", name, runs)
+		}
+		for _, file := range []string{"user_playlists.csv", "other_playlists.csv"} {
+			for key := range flagged(t, readCSV(t, filepath.Join("playlists", name, file))) {
+				missing[strings.SplitN(key, "/", 2)[1]] = true
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join("playlists", "user_playlists.csv")); !os.IsNotExist(err) {
+		t.Errorf("expected no single account output, got %v", err)
+	}
+
+	// Both accounts see the same playlists, so every missing track is missing from both
+	rows := readCSV(t, filepath.Join("playlists", "combined_report.csv"))
+	name, missingFrom, coveredBy := column(t, rows, "Track Name"), column(t, rows, "Missing From"), column(t, rows, "In Top Tracks Of")
+	if len(rows) < 2 {
+		t.Fatal("expected tracks in the combined report")
+	}
+	for _, row := range rows[1:] {
+		if row[missingFrom] != "alice, bob" || row[coveredBy] != "" || !missing[row[name]] {
+			t.Errorf("unexpected combined report row %v", row)
+		}
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_MAX_RETRIES":      "2",
+		"SPOTIFY_RETRY_BASE_DELAY": "1ms",
+		"SPOTIFY_RETRY_MAX_DELAY":  "10ms",
+	})
+	server.RateLimit("/v1/me/playlists", 2, 0)
+	server.Fail("/v1/playlists/pl-bulk/tracks", 1, http.StatusBadGateway)
+	server.Fail("/v1/playlists/pl-friend/tracks", -1, http.StatusServiceUnavailable)
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	// Transient failures are retried and the playlists are complete
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	if got := len(user) - 1; got != 118 {
+		t.Errorf("expected 118 user tracks, got %d", got)
+	}
+
+	// The playlist that keeps failing is retried, then reported
+	if got := server.Requests("/v1/playlists/pl-friend/tracks"); got != 3 {
+		t.Errorf("expected 3 attempts for pl-friend, got %d", got)
+	}
+	failed := readCSV(t, filepath.Join("playlists", "failed_playlists.csv"))
+	if len(failed) != 2 || failed[1][0] != "Friend’s Mix" || failed[1][1] != "pl-friend" {
+		t.Errorf("unexpected failed playlists output: %v", failed)
+	}
+	if _, err := os.Stat(filepath.Join("playlists", "other_playlists.csv")); !os.IsNotExist(err) {
+		t.Errorf("expected no other playlists output, got %v", err)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_RETRY_MAX_DELAY": "1m",
+	})
+	// Keep the run waiting on a rate limit until it is cancelled
+	server.RateLimit("/v1/playlists/pl-road-trip/tracks", 1, 30)
+
+	if err := os.MkdirAll("playlists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := []byte("previous output")
+	if err := os.WriteFile(filepath.Join("playlists", "user_playlists.csv"), previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	if err := run(ctx); err == nil {
+		t.Fatal("expected a cancelled run to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run took %s to stop after cancellation", elapsed)
+	}
+
+	// The previous output is untouched and no temporary files are left behind
+	data, err := os.ReadFile(filepath.Join("playlists", "user_playlists.csv"))
+	if err != nil || string(data) != string(previous) {
+		t.Errorf("expected previous output to be kept, got %q (%v)", data, err)
+	}
+	entries, err := os.ReadDir("playlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the previous output file, found %d files", len(entries))
+	}
+}
+
+func TestRunCache(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", nil)
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("first run failed: %v", err)
+	}
+	first := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	fetched := server.Requests("/v1/playlists/pl-road-trip/tracks")
+
+	// Unchanged playlists are served from the cache
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	if got := server.Requests("/v1/playlists/pl-road-trip/tracks"); got != fetched {
+		t.Errorf("expected no new track requests, got %d more", got-fetched)
+	}
+	second := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Error("expected cached output to match the first run")
+	}
+	// Nothing changed since the first run
+	if changes := readCSV(t, filepath.Join("playlists", "changes.csv")); len(changes) != 1 {
+		t.Errorf("expected no changes, got %v", changes[1:])
+	}
+
+	// Tracks cached for another market are fetched again
+	t.Setenv("SPOTIFY_MARKET", "US")
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run with another market failed: %v", err)
+	}
+	if got := server.Requests("/v1/playlists/pl-road-trip/tracks"); got != 2*fetched {
+		t.Errorf("expected tracks to be fetched for the new market, got %d requests", got)
+	}
+
+	// Force refresh ignores the cache
+	t.Setenv("SPOTIFY_FORCE_REFRESH", "true")
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("forced run failed: %v", err)
+	}
+	if got := server.Requests("/v1/playlists/pl-road-trip/tracks"); got != 3*fetched {
+		t.Errorf("expected tracks to be fetched again, got %d requests", got)
+	}
+}
+
+func TestRunFuzzyMatch(t *testing.T) {
+	setupRun(t, "e2e_fixture.json", map[string]string{"SPOTIFY_FUZZY_MATCH": "true"})
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("first run failed: %v", err)
+	}
+
+	// The re-recording has its own ID and ISRC but resembles the 2021 top track
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	flag, strategy, score := column(t, user, "NotInTopTrackPlaylist"), column(t, user, "Match Strategy"), column(t, user, "Match Score")
+	find := func(rows [][]string, name string) []string {
+		for _, row := range rows[1:] {
+			if row[1] == name {
+				return row
+			}
+		}
+		t.Fatalf("track %q not found", name)
+		return nil
+	}
+	row := find(user, "Golden Hour (Alpha's Version)")
+	if row[flag] != "POSSIBLE_MATCH" || row[strategy] != "fuzzy" || row[score] == "" {
+		t.Errorf("expected a possible match with a score, got %v", row)
+	}
+	if row := find(user, "Missing Piece"); row[flag] != "TRUE" || row[score] != "" {
+		t.Errorf("expected Missing Piece to stay flagged without a near match, got %v", row)
+	}
+
+	review := readCSV(t, filepath.Join("playlists", "match_review.csv"))
+	if len(review) != 2 {
+		t.Fatalf("expected one possible match to review, got %v", review)
+	}
+	candidate := column(t, review, "Candidate ID")
+	if review[1][column(t, review, "Track ID")] != "track-9" || review[1][candidate] != "track-1" {
+		t.Errorf("unexpected possible match: %v", review[1])
+	}
+
+	// Confirming the match in the review file is honored on the next run and saved
+	review[1][0] = "Confirm"
+	var buf strings.Builder
+	writer := csv.NewWriter(&buf)
+	writer.WriteAll(review)
+	if err := os.WriteFile(filepath.Join("playlists", "match_review.csv"), []byte(buf.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	user = readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	if row := find(user, "Golden Hour (Alpha's Version)"); row[flag] != "" || row[strategy] != "fuzzy" {
+		t.Errorf("expected the confirmed match not to be flagged, got %v", row)
+	}
+	if review := readCSV(t, filepath.Join("playlists", "match_review.csv")); len(review) != 1 {
+		t.Errorf("expected nothing left to review, got %v", review[1:])
+	}
+	if _, err := os.Stat("match_decisions.json"); err != nil {
+		t.Errorf("expected the decision to be saved: %v", err)
+	}
+}
+
+func TestRunReleaseYears(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{"SPOTIFY_EARLIEST_ISRC_YEAR": "true"})
+	overrides := "ID,Year,Note\n# Missing Piece was first released as a demo\ntrack-3,2019,demo\n"
+	if err := os.WriteFile("release_year_overrides.csv", []byte(overrides), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	year, source, flag := column(t, user, "Release Year"), column(t, user, "Year Source"), column(t, user, "NotInTopTrackPlaylist")
+	want := map[string][]string{
+		// The compilation track counts for the year of its original release, outside the range
+		"Evergreen": {"1975", "earliest_isrc", ""},
+		// The override moves the track out of 2021
+		"Missing Piece": {"2019", "override", ""},
+		"Late Bloomer":  {"2021", "album", "TRUE"},
+	}
+	for _, row := range user[1:] {
+		if row[0] != "Road Trip" {
+			continue
+		}
+		if expected, ok := want[row[1]]; ok {
+			if got := []string{row[year], row[source], row[flag]}; strings.Join(got, "|") != strings.Join(expected, "|") {
+				t.Errorf("%s: expected year, source and flag %v, got %v", row[1], expected, got)
+			}
+			delete(want, row[1])
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("tracks not found: %v", want)
+	}
+
+	// Earliest years are cached, so a second run searches no more
+	searches := server.Requests("/v1/search")
+	if searches == 0 {
+		t.Fatal("expected releases to be searched")
+	}
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	if got := server.Requests("/v1/search"); got != searches {
+		t.Errorf("expected no new searches, got %d more", got-searches)
+	}
+}
+
+func TestRunLibrary(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_INCLUDE_LIKED_SONGS":  "true",
+		"SPOTIFY_INCLUDE_SAVED_ALBUMS": "true",
+	})
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	// Liked Songs and each saved album follow the playlists as playlists of their own
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	flag := column(t, user, "NotInTopTrackPlaylist")
+	var library []string
+	for _, row := range user[1:] {
+		if row[0] == "Liked Songs" || strings.HasPrefix(row[0], "Album: ") {
+			library = append(library, row[0]+"/"+row[1]+"/"+row[flag])
+		}
+	}
+	want := []string{
+		"Liked Songs/Golden Hour/",
+		"Liked Songs/Heart Song/TRUE",
+		"Album: Long Player/Side A/TRUE",
+		"Album: Long Player/Side B/TRUE",
+		"Album: Long Player/Hidden Track/TRUE",
+	}
+	if strings.Join(library, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected library tracks: %v", library)
+	}
+	if got := server.Requests("/v1/albums/al-long-player/tracks"); got != 1 {
+		t.Errorf("expected the rest of the album to be fetched once, got %d requests", got)
+	}
+}
+
+func TestRunListeningReport(t *testing.T) {
+	server := setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_LISTENING_REPORT": "true",
+	})
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	// Golden Hour is in the 2021 top tracks playlist; the others are missing from theirs
+	report := readCSV(t, filepath.Join("playlists", "listening_report.csv"))
+	score, recent := column(t, report, "Score"), column(t, report, "Recent Plays")
+	var got []string
+	for _, row := range report[1:] {
+		got = append(got, row[0]+"/"+row[score]+"/"+row[recent])
+	}
+	want := []string{"Missing Piece/104/1", "Evergreen/10/2"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected listening report: %v", got)
+	}
+	// Only the recently played track outside the top tracks needs its album fetched
+	if got := server.Requests("/v1/tracks"); got != 1 {
+		t.Errorf("expected 1 track lookup, got %d", got)
+	}
+}
+
+func TestRunStreamingHistory(t *testing.T) {
+	historyDir, err := filepath.Abs(filepath.Join("testdata", "streaming_history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_STREAMING_HISTORY_DIR": historyDir,
+	})
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	user := readCSV(t, filepath.Join("playlists", "user_playlists.csv"))
+	plays, minutes := column(t, user, "Play Count"), column(t, user, "Minutes Played")
+	got := make(map[string]string)
+	for _, row := range user[1:] {
+		if row[0] == "Road Trip" {
+			got[row[1]] = row[plays] + "/" + row[minutes]
+		}
+	}
+	// The skip adds time but no play; the other release of Night Drive is found by name
+	want := map[string]string{
+		"Missing Piece": "2/5.1",
+		"Night Drive":   "1/3.3",
+		"Golden Hour":   "0/0.0",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s: expected plays/minutes %s, got %s", name, value, got[name])
+		}
+	}
+	// The history is read from disk only
+	if got := server.Requests("/v1/me/player/recently-played"); got != 0 {
+		t.Errorf("expected no listening history requests, got %d", got)
+	}
+}
+
+func TestRunSuggestions(t *testing.T) {
+	historyDir, err := filepath.Abs(filepath.Join("testdata", "streaming_history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupRun(t, "e2e_fixture.json", map[string]string{
+		"SPOTIFY_SUGGESTIONS":           "true",
+		"SPOTIFY_STREAMING_HISTORY_DIR": historyDir,
+	})
+	// A ranking left by an earlier run for a year without candidates now
+	if err := os.MkdirAll("playlists", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("playlists", "suggestions_2020.csv"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	// Missing Piece leads 2021 on its plays that year, leaving out its 2022 play; the
+	// artist of Golden Hour is already in the 2021 top tracks playlist, and Late Bloomer
+	// is in two playlists
+	rows := readCSV(t, filepath.Join("playlists", "suggestions_2021.csv"))
+	want := []string{
+		"1,Missing Piece,58.3,1,1,",
+		"2,Golden Hour (Alpha's Version),38.3,1,0,TRUE",
+		"3,Late Bloomer,33.3,2,0,",
+	}
+	score, playlists := column(t, rows, "Score"), column(t, rows, "Playlists")
+	plays, artist := column(t, rows, "Play Count"), column(t, rows, "Artist In Top Tracks")
+	var got []string
+	for _, row := range rows[1:] {
+		got = append(got, strings.Join([]string{row[0], row[1], row[score], row[playlists], row[plays], row[artist]}, ","))
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected 2021 suggestions: %v", got)
+	}
+
+	// Every year with missing tracks gets its own file
+	for _, year := range []string{"2022", "2024"} {
+		if _, err := os.Stat(filepath.Join("playlists", "suggestions_"+year+".csv")); err != nil {
+			t.Errorf("expected suggestions for %s: %v", year, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("playlists", "suggestions_2020.csv")); !os.IsNotExist(err) {
+		t.Errorf("expected the stale suggestions for 2020 to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(path, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Errorf("expected the new contents, got %q (%v)", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected permissions 0600, got %v (%v)", info.Mode().Perm(), err)
+	}
+
+	// Concurrent writers each leave a complete file and no temporary files
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := WriteFile(path, []byte(fmt.Sprintf("writer %d", i)), 0644); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	data, _ = os.ReadFile(path)
+	var complete bool
+	for i := 0; i < 10; i++ {
+		complete = complete || string(data) == fmt.Sprintf("writer %d", i)
+	}
+	if !complete {
+		t.Errorf("expected one writer's contents, got %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary files, found %d files", len(entries))
+	}
+
+	// A missing directory fails without creating anything
+	if err := WriteFile(filepath.Join(dir, "missing", "state.json"), []byte("x"), 0644); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
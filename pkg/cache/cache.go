@@ -0,0 +1,138 @@
+// Package cache stores the tracks of playlists on disk, keyed by playlist ID,
+// snapshot ID and market. Spotify changes a playlist's snapshot ID whenever its
+// contents change, so a cached entry with the current snapshot ID is up to date as
+// long as the tracks were fetched for the same market, which decides their
+// availability and relinking.
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/atomicfile"
+	"github.com/zmb3/spotify"
+)
+
+// Stats counts cache lookups and writes
+type Stats struct {
+	Hits   int
+	Misses int
+	Stale  int
+	Errors int
+	Writes int
+}
+
+// Cache is a directory of cached playlists, one JSON file per playlist
+type Cache struct {
+	dir string
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// entry is the on-disk representation of a cached playlist
+type entry struct {
+	PlaylistID string                  `json:"playlist_id"`
+	SnapshotID string                  `json:"snapshot_id"`
+	Market     string                  `json:"market,omitempty"`
+	FetchedAt  time.Time               `json:"fetched_at"`
+	Items      []spotify.PlaylistTrack `json:"items"`
+}
+
+// New creates a cache in dir, creating the directory if needed
+func New(dir string) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "playlists"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// Get returns the cached items of a playlist if they were cached for the same
+// snapshot and market
+func (c *Cache) Get(playlistID, snapshotID, market string) ([]spotify.PlaylistTrack, bool) {
+	path, ok := c.path(playlistID)
+	if !ok || snapshotID == "" {
+		c.record(func(s *Stats) { s.Misses++ })
+		return nil, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.record(func(s *Stats) {
+			if os.IsNotExist(err) {
+				s.Misses++
+			} else {
+				s.Errors++
+			}
+		})
+		return nil, false
+	}
+
+	var cached entry
+	if err := json.Unmarshal(data, &cached); err != nil || cached.PlaylistID != playlistID {
+		c.record(func(s *Stats) { s.Errors++ })
+		return nil, false
+	}
+	if cached.SnapshotID != snapshotID || cached.Market != market {
+		c.record(func(s *Stats) { s.Stale++ })
+		return nil, false
+	}
+
+	c.record(func(s *Stats) { s.Hits++ })
+	return cached.Items, true
+}
+
+// Put stores the items of a playlist fetched for a snapshot and market, replacing
+// any older entry
+func (c *Cache) Put(playlistID, snapshotID, market string, items []spotify.PlaylistTrack) error {
+	path, ok := c.path(playlistID)
+	if !ok || snapshotID == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(entry{
+		PlaylistID: playlistID,
+		SnapshotID: snapshotID,
+		Market:     market,
+		FetchedAt:  time.Now().UTC(),
+		Items:      items,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save cache entry: %v", err)
+	}
+
+	c.record(func(s *Stats) { s.Writes++ })
+	return nil
+}
+
+// Stats returns a copy of the statistics collected so far
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// path returns the file of a playlist's entry. IDs that can't be used as a file
+// name are never cached.
+func (c *Cache) path(playlistID string) (string, bool) {
+	if playlistID == "" || strings.ContainsAny(playlistID, `/\.:`) {
+		return "", false
+	}
+	return filepath.Join(c.dir, "playlists", playlistID+".json"), true
+}
+
+// record updates the statistics under the lock
+func (c *Cache) record(update func(*Stats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&c.stats)
+}
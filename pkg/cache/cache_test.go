@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+// items returns playlist items for the given track names
+func items(names ...string) []spotify.PlaylistTrack {
+	var result []spotify.PlaylistTrack
+	for _, name := range names {
+		track := spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(name), Name: name}}
+		result = append(result, spotify.PlaylistTrack{AddedAt: "2024-01-01T00:00:00Z", Track: track})
+	}
+	return result
+}
+
+func TestCache(t *testing.T) {
+	c, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.Get("pl1", "snap1", "DE"); ok {
+		t.Fatal("expected a miss for an empty cache")
+	}
+	if err := c.Put("pl1", "snap1", "DE", items("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, ok := c.Get("pl1", "snap1", "DE")
+	if !ok || len(cached) != 2 || cached[1].Track.Name != "b" || cached[0].AddedAt != "2024-01-01T00:00:00Z" {
+		t.Fatalf("unexpected cached items: %v %+v", ok, cached)
+	}
+
+	// A new snapshot means the playlist changed
+	if _, ok := c.Get("pl1", "snap2", "DE"); ok {
+		t.Error("expected a stale entry for a new snapshot")
+	}
+	// Tracks fetched for another market may differ in availability and relinking
+	for _, market := range []string{"US", ""} {
+		if _, ok := c.Get("pl1", "snap1", market); ok {
+			t.Errorf("expected a stale entry for market %q", market)
+		}
+	}
+
+	want := Stats{Hits: 1, Misses: 1, Stale: 3, Writes: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("unexpected stats: %+v", got)
+	}
+}
+
+func TestCacheRejectsUnsafeIDs(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("../escape", "snap", "", items("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.json")); !os.IsNotExist(err) {
+		t.Error("expected unsafe playlist IDs not to be cached")
+	}
+	if _, ok := c.Get("../escape", "snap", ""); ok {
+		t.Error("expected a miss for an unsafe playlist ID")
+	}
+}
+
+func TestCacheCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "playlists", "pl1.json"), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("pl1", "snap1", ""); ok {
+		t.Error("expected a corrupt entry to be ignored")
+	}
+	if got := c.Stats().Errors; got != 1 {
+		t.Errorf("expected 1 error, got %d", got)
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mikev/spotify-analysis/pkg/atomicfile"
+)
+
+// releaseYearsFile holds the earliest release year found for each ISRC. A recording
+// keeps its ISRC across releases, so the earliest year rarely changes and searching
+// for it again on every run would only cost API requests.
+const releaseYearsFile = "release_years.json"
+
+// ReleaseYears returns the saved earliest release years by ISRC. A missing or
+// unreadable file returns no years, so they are searched for again.
+func (c *Cache) ReleaseYears() map[string]string {
+	years := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(c.dir, releaseYearsFile))
+	if err != nil {
+		return years
+	}
+	if err := json.Unmarshal(data, &years); err != nil {
+		return make(map[string]string)
+	}
+	return years
+}
+
+// SaveReleaseYears replaces the saved earliest release years
+func (c *Cache) SaveReleaseYears(years map[string]string) error {
+	data, err := json.MarshalIndent(years, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode release years: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(filepath.Join(c.dir, releaseYearsFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to save release years: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+// Package changes keeps the results of every run and reports what changed since
+// the previous run: tracks that became or stopped being flagged as missing from
+// the top tracks playlists, added and removed playlists, and added and removed tracks.
+package changes
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/mikev/spotify-analysis/pkg/processor"
+)
+
+// Types of change
+const (
+	NewlyFlagged    = "Newly Flagged"
+	Resolved        = "Resolved"
+	PlaylistAdded   = "Playlist Added"
+	PlaylistRemoved = "Playlist Removed"
+	TrackAdded      = "Track Added"
+	TrackRemoved    = "Track Removed"
+)
+
+// Snapshot is the saved result of one run
+type Snapshot struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Playlists []PlaylistState `json:"playlists"`
+}
+
+// PlaylistState is a playlist and its tracks as seen by one run
+type PlaylistState struct {
+	ID     string       `json:"id"`
+	Name   string       `json:"name"`
+	Owner  string       `json:"owner"`
+	Tracks []TrackState `json:"tracks"`
+}
+
+// TrackState is a track in a playlist and whether it was flagged as missing from the top tracks playlists
+type TrackState struct {
+	ID      string `json:"id,omitempty"`
+	Name    string `json:"name"`
+	Artists string `json:"artists"`
+	Flagged bool   `json:"flagged,omitempty"`
+}
+
+// Change is a single difference between two runs
+type Change struct {
+	Type      string
+	Playlist  string
+	TrackName string
+	Artists   string
+	TrackID   string
+}
+
+// NewSnapshot builds the snapshot of a run. Playlists that failed to load in this
+// run keep their state from the previous snapshot, so they are not reported as
+// removed now and added again next time.
+func NewSnapshot(result *processor.Result, previous *Snapshot) *Snapshot {
+	tracksByPlaylist := make(map[string][]TrackState)
+	for _, key := range []string{"user", "other"} {
+		for _, track := range result.Tracks[key] {
+			tracksByPlaylist[track.PlaylistID] = append(tracksByPlaylist[track.PlaylistID], TrackState{
+				ID:      track.TrackID,
+				Name:    track.TrackName,
+				Artists: track.Artists,
+				Flagged: track.Flagged(),
+			})
+		}
+	}
+
+	snapshot := &Snapshot{CreatedAt: time.Now().UTC()}
+	for _, playlist := range result.Playlists {
+		snapshot.Playlists = append(snapshot.Playlists, PlaylistState{
+			ID:     playlist.ID,
+			Name:   playlist.Name,
+			Owner:  playlist.Owner,
+			Tracks: tracksByPlaylist[playlist.ID],
+		})
+	}
+
+	if previous != nil {
+		old := playlistsByID(previous)
+		for _, failed := range result.Failed {
+			if state, exists := old[failed.PlaylistID]; exists {
+				snapshot.Playlists = append(snapshot.Playlists, state)
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// Compare returns the changes from the previous snapshot to the current one.
+// Flag changes come first, then playlist and track changes in playlist order.
+func Compare(previous, current *Snapshot) []Change {
+	var changes []Change
+	changes = append(changes, compareFlags(previous, current)...)
+
+	old := playlistsByID(previous)
+	seen := make(map[string]bool)
+	for _, playlist := range current.Playlists {
+		seen[playlist.ID] = true
+		before, exists := old[playlist.ID]
+		if !exists {
+			changes = append(changes, Change{Type: PlaylistAdded, Playlist: playlist.Name})
+			continue
+		}
+		changes = append(changes, compareTracks(before, playlist)...)
+	}
+	for _, playlist := range previous.Playlists {
+		if !seen[playlist.ID] {
+			changes = append(changes, Change{Type: PlaylistRemoved, Playlist: playlist.Name})
+		}
+	}
+
+	return changes
+}
+
+// compareFlags finds tracks that are newly flagged, and flagged tracks that were
+// resolved by being added to a top tracks playlist
+func compareFlags(previous, current *Snapshot) []Change {
+	wasFlagged := make(map[string]bool)
+	for _, playlist := range previous.Playlists {
+		for _, track := range playlist.Tracks {
+			if track.Flagged {
+				wasFlagged[trackKey(track)] = true
+			}
+		}
+	}
+
+	// Group the current occurrences of each track, in order of first appearance
+	var order []string
+	tracks := make(map[string]TrackState)
+	playlists := make(map[string][]string)
+	for _, playlist := range current.Playlists {
+		for _, track := range playlist.Tracks {
+			key := trackKey(track)
+			if _, exists := tracks[key]; !exists {
+				order = append(order, key)
+				tracks[key] = track
+			}
+			if track.Flagged {
+				tracks[key] = track
+			}
+			playlists[key] = match.AppendUnique(playlists[key], playlist.Name)
+		}
+	}
+
+	var changes []Change
+	for _, key := range order {
+		track := tracks[key]
+		var changeType string
+		switch {
+		case track.Flagged && !wasFlagged[key]:
+			changeType = NewlyFlagged
+		case !track.Flagged && wasFlagged[key]:
+			changeType = Resolved
+		default:
+			continue
+		}
+		changes = append(changes, Change{
+			Type:      changeType,
+			Playlist:  strings.Join(playlists[key], ", "),
+			TrackName: track.Name,
+			Artists:   track.Artists,
+			TrackID:   track.ID,
+		})
+	}
+	return changes
+}
+
+// compareTracks finds the tracks added to and removed from a playlist
+func compareTracks(before, after PlaylistState) []Change {
+	var changes []Change
+	oldKeys := trackKeys(before)
+	newKeys := trackKeys(after)
+
+	for _, track := range after.Tracks {
+		key := trackKey(track)
+		if !oldKeys[key] {
+			changes = append(changes, trackChange(TrackAdded, after.Name, track))
+			oldKeys[key] = true // report duplicates once
+		}
+	}
+	for _, track := range before.Tracks {
+		key := trackKey(track)
+		if !newKeys[key] {
+			changes = append(changes, trackChange(TrackRemoved, after.Name, track))
+			newKeys[key] = true
+		}
+	}
+	return changes
+}
+
+// trackChange creates a change for a track in a playlist
+func trackChange(changeType, playlist string, track TrackState) Change {
+	return Change{
+		Type:      changeType,
+		Playlist:  playlist,
+		TrackName: track.Name,
+		Artists:   track.Artists,
+		TrackID:   track.ID,
+	}
+}
+
+// trackKey identifies a track across runs. Local files have no ID, so they are
+// identified by name and artists.
+func trackKey(track TrackState) string {
+	if track.ID != "" {
+		return track.ID
+	}
+	return strings.ToLower(track.Name) + "|" + strings.ToLower(track.Artists)
+}
+
+// trackKeys returns the set of track keys in a playlist
+func trackKeys(playlist PlaylistState) map[string]bool {
+	keys := make(map[string]bool, len(playlist.Tracks))
+	for _, track := range playlist.Tracks {
+		keys[trackKey(track)] = true
+	}
+	return keys
+}
+
+// playlistsByID indexes the playlists of a snapshot by ID
+func playlistsByID(snapshot *Snapshot) map[string]PlaylistState {
+	result := make(map[string]PlaylistState, len(snapshot.Playlists))
+	for _, playlist := range snapshot.Playlists {
+		result[playlist.ID] = playlist
+	}
+	return result
+}
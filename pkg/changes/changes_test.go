@@ -0,0 +1,127 @@
+package changes
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/processor"
+)
+
+// snapshot builds a snapshot of the given playlists
+func snapshot(playlists ...PlaylistState) *Snapshot {
+	return &Snapshot{Playlists: playlists}
+}
+
+// playlist builds a playlist state; track names ending in "!" are flagged
+func playlist(id string, tracks ...string) PlaylistState {
+	state := PlaylistState{ID: id, Name: "Playlist " + id}
+	for _, name := range tracks {
+		flagged := name[len(name)-1] == '!'
+		if flagged {
+			name = name[:len(name)-1]
+		}
+		state.Tracks = append(state.Tracks, TrackState{ID: "id-" + name, Name: name, Flagged: flagged})
+	}
+	return state
+}
+
+func TestCompare(t *testing.T) {
+	previous := snapshot(
+		playlist("top", "a"),
+		playlist("mix", "a", "b!", "c!"),
+		playlist("gone", "d"),
+	)
+	current := snapshot(
+		playlist("top", "a", "b"),
+		playlist("mix", "a", "b", "c!", "e!"),
+		playlist("new", "f"),
+	)
+
+	var got []string
+	for _, change := range Compare(previous, current) {
+		got = append(got, fmt.Sprintf("%s|%s|%s", change.Type, change.Playlist, change.TrackName))
+	}
+	want := []string{
+		"Resolved|Playlist top, Playlist mix|b",
+		"Newly Flagged|Playlist mix|e",
+		"Track Added|Playlist top|b",
+		"Track Added|Playlist mix|e",
+		"Playlist Added|Playlist new|",
+		"Playlist Removed|Playlist gone|",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected changes:\n got: %v\nwant: %v", got, want)
+	}
+
+	// Removed tracks are reported for the playlist they left
+	removed := Compare(current, previous)
+	found := false
+	for _, change := range removed {
+		if change.Type == TrackRemoved && change.Playlist == "Playlist mix" && change.TrackName == "e" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected e to be reported as removed from mix, got %v", removed)
+	}
+}
+
+func TestNewSnapshotKeepsFailedPlaylists(t *testing.T) {
+	previous := snapshot(playlist("ok", "a"), playlist("flaky", "b"))
+	result := &processor.Result{
+		Tracks: map[string][]processor.TrackData{
+			"user": {{PlaylistID: "ok", PlaylistName: "Playlist ok", TrackID: "id-a", TrackName: "a"}},
+		},
+		Playlists: []processor.PlaylistInfo{{ID: "ok", Name: "Playlist ok"}},
+		Failed:    []processor.FailedPlaylist{{PlaylistID: "flaky", PlaylistName: "Playlist flaky"}},
+	}
+
+	current := NewSnapshot(result, previous)
+	if len(current.Playlists) != 2 || current.Playlists[1].ID != "flaky" {
+		t.Fatalf("expected the failed playlist to be carried over, got %+v", current.Playlists)
+	}
+	if changes := Compare(previous, current); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := NewStore(t.TempDir(), 0)
+	if latest, _, err := store.Latest(); err != nil || latest != nil {
+		t.Fatalf("expected no runs, got %v %v", latest, err)
+	}
+
+	first := snapshot(playlist("p1", "a"))
+	if _, err := store.Save(first); err != nil {
+		t.Fatal(err)
+	}
+	latest, _, err := store.Latest()
+	if err != nil || len(latest.Playlists) != 1 || latest.Playlists[0].Tracks[0].Name != "a" {
+		t.Fatalf("unexpected latest run: %+v %v", latest, err)
+	}
+}
+
+func TestStoreKeepsRecentRuns(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir, 2)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		run := snapshot(playlist("p1", name))
+		run.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		if _, err := store.Save(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "run-*.json"))
+	if len(paths) != 2 || !strings.HasSuffix(paths[0], "run-20240101-140000.000.json") {
+		t.Fatalf("expected the two latest runs to be kept, got %v", paths)
+	}
+	latest, _, err := store.Latest()
+	if err != nil || latest.Playlists[0].Tracks[0].Name != "d" {
+		t.Errorf("unexpected latest run: %+v %v", latest, err)
+	}
+}
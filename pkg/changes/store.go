@@ -0,0 +1,98 @@
+package changes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mikev/spotify-analysis/pkg/atomicfile"
+)
+
+// Store keeps one snapshot file per run in a directory
+type Store struct {
+	dir  string
+	keep int
+}
+
+// NewStore creates a store for the snapshots in dir that keeps the keep most recent
+// runs, or every run if keep is 0
+func NewStore(dir string, keep int) *Store {
+	return &Store{dir: dir, keep: keep}
+}
+
+// Latest returns the most recent snapshot and its path. It returns a nil snapshot
+// and no error if no run has been saved yet.
+func (s *Store) Latest() (*Snapshot, string, error) {
+	paths, err := s.runs()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(paths) == 0 {
+		return nil, "", nil
+	}
+	path := paths[len(paths)-1]
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read run %s: %v", path, err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, "", fmt.Errorf("failed to parse run %s: %v", path, err)
+	}
+	return &snapshot, path, nil
+}
+
+// Save writes a snapshot to a new file named after its creation time and returns its
+// path. Runs beyond the number to keep are removed, oldest first.
+func (s *Store) Save(snapshot *Snapshot) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode run: %v", err)
+	}
+
+	name := "run-" + snapshot.CreatedAt.Format("20060102-150405.000") + ".json"
+	path := filepath.Join(s.dir, name)
+
+	if err := atomicfile.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to save run: %v", err)
+	}
+	s.prune()
+	return path, nil
+}
+
+// runs returns the paths of the saved runs, oldest first
+func (s *Store) runs() ([]string, error) {
+	// Snapshot file names start with a sortable timestamp
+	paths, err := filepath.Glob(filepath.Join(s.dir, "run-*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs: %v", err)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// prune removes the oldest runs beyond the number to keep. A run that can't be
+// removed is only logged, since the new run was saved.
+func (s *Store) prune() {
+	if s.keep <= 0 {
+		return
+	}
+	paths, err := s.runs()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	for i := 0; i < len(paths)-s.keep; i++ {
+		if err := os.Remove(paths[i]); err != nil {
+			log.Printf("Warning: failed to remove old run %s: %v", paths[i], err)
+		}
+	}
+}
@@ -4,26 +4,79 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/mikev/spotify-analysis/pkg/releaseyear"
 )
 
+// Supported OAuth authorization flows
+const (
+	AuthFlowCode = "code"
+	AuthFlowPKCE = "pkce"
+)
+
+// DefaultTopTracksYearRegex finds a four-digit year, or an abbreviated one such as '21,
+// in a top tracks playlist name
+const DefaultTopTracksYearRegex = `\b((?:19|20)\d{2})\b|'(\d{2})\b`
+
 // Config holds all configuration values
 type Config struct {
-	ClientID              string
-	ClientSecret          string
-	RedirectURI           string
-	Port                  int
-	TopTracksPattern      string
-	StartYear             string
-	EndYear               string
-	IncludeOtherPlaylists bool
-	OverwriteFiles        bool
-	LogFile               string
-	LogRotateSize         string
-	LogKeepFiles          int
+	ClientID                string
+	ClientSecret            string
+	AuthFlow                string
+	Headless                bool
+	AuthMaxAttempts         int
+	RedirectURI             string
+	Port                    int
+	PortRangeStart          int
+	PortRangeEnd            int
+	AllowRedirectPortChange bool
+	KillPortOwner           bool
+	TopTracksPatterns       []*regexp.Regexp
+	TopTracksPlaylistIDs    map[string]string
+	TopTracksYearRegex      *regexp.Regexp
+	MatchStrategies         []string
+	FuzzyMatch              bool
+	FuzzyThreshold          float64
+	FuzzyDurationTolerance  time.Duration
+	MatchDecisionsFile      string
+	ReleaseYearOverrides    string
+	EarliestISRCYear        bool
+	Market                  string
+	MatchNonMusic           bool
+	IncludeLikedSongs       bool
+	IncludeSavedAlbums      bool
+	ListeningReport         bool
+	StreamingHistoryDir     string
+	Suggestions             bool
+	StartYear               int
+	EndYear                 int
+	IncludeOtherPlaylists   bool
+	OverwriteFiles          bool
+	LogFile                 string
+	LogRotateSize           string
+	LogKeepFiles            int
+	TokenFile               string
+	TokenKey                string
+	Accounts                []string
+	Account                 string
+	APIURL                  string
+	AccountsURL             string
+	MaxRetries              int
+	RetryBaseDelay          time.Duration
+	RetryMaxDelay           time.Duration
+	Workers                 int
+	RequestsPerSecond       float64
+	CacheDir                string
+	ForceRefresh            bool
+	HistoryDir              string
+	HistoryKeepRuns         int
 }
 
 // LoadConfig loads and validates all configuration from environment variables
@@ -35,42 +88,209 @@ func LoadConfig() (*Config, error) {
 	// Get required environment variables
 	clientID := os.Getenv("SPOTIFY_CLIENT_ID")
 	clientSecret := os.Getenv("SPOTIFY_CLIENT_SECRET")
+	authFlow := strings.ToLower(os.Getenv("SPOTIFY_AUTH_FLOW"))
+	headless := os.Getenv("SPOTIFY_HEADLESS")
+	authMaxAttempts := os.Getenv("SPOTIFY_AUTH_MAX_ATTEMPTS")
 	redirectURI := os.Getenv("SPOTIFY_REDIRECT_URI")
 	port := os.Getenv("SPOTIFY_PORT")
+	portRange := os.Getenv("SPOTIFY_PORT_RANGE")
+	allowRedirectPortChange := os.Getenv("SPOTIFY_ALLOW_REDIRECT_PORT_CHANGE")
+	killPortOwner := os.Getenv("SPOTIFY_KILL_PORT_OWNER")
 	topTracksPattern := os.Getenv("SPOTIFY_TOP_TRACKS_PATTERN")
+	topTracksPatterns := os.Getenv("SPOTIFY_TOP_TRACKS_PATTERNS")
+	topTracksPlaylistIDs := os.Getenv("SPOTIFY_TOP_TRACKS_PLAYLIST_IDS")
+	topTracksYearRegex := os.Getenv("SPOTIFY_TOP_TRACKS_YEAR_REGEX")
+	matchStrategies := os.Getenv("SPOTIFY_MATCH_STRATEGIES")
+	fuzzyMatch := os.Getenv("SPOTIFY_FUZZY_MATCH")
+	fuzzyThreshold := os.Getenv("SPOTIFY_FUZZY_THRESHOLD")
+	fuzzyDurationTolerance := os.Getenv("SPOTIFY_FUZZY_DURATION_TOLERANCE")
+	matchDecisionsFile := os.Getenv("SPOTIFY_MATCH_DECISIONS_FILE")
+	releaseYearOverrides := os.Getenv("SPOTIFY_RELEASE_YEAR_OVERRIDES_FILE")
+	earliestISRCYear := os.Getenv("SPOTIFY_EARLIEST_ISRC_YEAR")
+	market := os.Getenv("SPOTIFY_MARKET")
+	matchNonMusic := os.Getenv("SPOTIFY_MATCH_NON_MUSIC")
 	startYear := os.Getenv("SPOTIFY_START_YEAR")
 	endYear := os.Getenv("SPOTIFY_END_YEAR")
 	includeOtherPlaylists := os.Getenv("SPOTIFY_INCLUDE_OTHER_PLAYLISTS")
+	includeLikedSongs := os.Getenv("SPOTIFY_INCLUDE_LIKED_SONGS")
+	includeSavedAlbums := os.Getenv("SPOTIFY_INCLUDE_SAVED_ALBUMS")
+	listeningReport := os.Getenv("SPOTIFY_LISTENING_REPORT")
+	streamingHistoryDir := os.Getenv("SPOTIFY_STREAMING_HISTORY_DIR")
+	suggestions := os.Getenv("SPOTIFY_SUGGESTIONS")
 	overwriteFiles := os.Getenv("SPOTIFY_OVERWRITE_FILES")
 	logFile := os.Getenv("SPOTIFY_LOG_FILE")
 	logRotateSize := os.Getenv("SPOTIFY_LOG_ROTATE_SIZE")
 	logKeepFiles := os.Getenv("SPOTIFY_LOG_KEEP_FILES")
+	tokenFile := os.Getenv("SPOTIFY_TOKEN_FILE")
+	tokenKey := os.Getenv("SPOTIFY_TOKEN_KEY")
+	accounts := os.Getenv("SPOTIFY_ACCOUNTS")
+	apiURL := os.Getenv("SPOTIFY_API_URL")
+	accountsURL := os.Getenv("SPOTIFY_ACCOUNTS_URL")
+	maxRetries := os.Getenv("SPOTIFY_MAX_RETRIES")
+	retryBaseDelay := os.Getenv("SPOTIFY_RETRY_BASE_DELAY")
+	retryMaxDelay := os.Getenv("SPOTIFY_RETRY_MAX_DELAY")
+	workers := os.Getenv("SPOTIFY_WORKERS")
+	requestsPerSecond := os.Getenv("SPOTIFY_REQUESTS_PER_SECOND")
+	cacheDir, cacheDirSet := os.LookupEnv("SPOTIFY_CACHE_DIR")
+	forceRefresh := os.Getenv("SPOTIFY_FORCE_REFRESH")
+	historyDir, historyDirSet := os.LookupEnv("SPOTIFY_HISTORY_DIR")
+	historyKeepRuns := os.Getenv("SPOTIFY_HISTORY_KEEP_RUNS")
 
 	// Log configuration values (excluding sensitive data)
 	log.Printf("Configuration loaded:")
+	log.Printf("  Auth Flow: %s", authFlow)
+	log.Printf("  Headless: %s", headless)
+	log.Printf("  Auth Max Attempts: %s", authMaxAttempts)
 	log.Printf("  Redirect URI: %s", redirectURI)
 	log.Printf("  Port: %s", port)
+	log.Printf("  Port Range: %s", portRange)
+	log.Printf("  Allow Redirect Port Change: %s", allowRedirectPortChange)
+	log.Printf("  Kill Port Owner: %s", killPortOwner)
 	log.Printf("  Top Tracks Pattern: %s", topTracksPattern)
+	log.Printf("  Top Tracks Patterns: %s", topTracksPatterns)
+	log.Printf("  Top Tracks Playlist IDs: %s", topTracksPlaylistIDs)
+	log.Printf("  Top Tracks Year Regex: %s", topTracksYearRegex)
+	log.Printf("  Match Strategies: %s", matchStrategies)
+	log.Printf("  Fuzzy Match: %s", fuzzyMatch)
+	log.Printf("  Fuzzy Threshold: %s", fuzzyThreshold)
+	log.Printf("  Fuzzy Duration Tolerance: %s", fuzzyDurationTolerance)
+	log.Printf("  Match Decisions File: %s", matchDecisionsFile)
+	log.Printf("  Release Year Overrides File: %s", releaseYearOverrides)
+	log.Printf("  Earliest ISRC Year: %s", earliestISRCYear)
+	log.Printf("  Market: %s", market)
+	log.Printf("  Match Non-Music: %s", matchNonMusic)
 	log.Printf("  Start Year: %s", startYear)
 	log.Printf("  End Year: %s", endYear)
 	log.Printf("  Include Other Playlists: %s", includeOtherPlaylists)
+	log.Printf("  Include Liked Songs: %s", includeLikedSongs)
+	log.Printf("  Include Saved Albums: %s", includeSavedAlbums)
+	log.Printf("  Listening Report: %s", listeningReport)
+	log.Printf("  Streaming History Dir: %s", streamingHistoryDir)
+	log.Printf("  Suggestions: %s", suggestions)
 	log.Printf("  Overwrite Files: %s", overwriteFiles)
 	log.Printf("  Log File: %s", logFile)
 	log.Printf("  Log Rotate Size: %s", logRotateSize)
 	log.Printf("  Log Keep Files: %s", logKeepFiles)
+	log.Printf("  Token File: %s", tokenFile)
+	log.Printf("  Token Encryption: %t", tokenKey != "")
+	log.Printf("  Accounts: %s", accounts)
+	log.Printf("  Max Retries: %s", maxRetries)
+	log.Printf("  Retry Base Delay: %s", retryBaseDelay)
+	log.Printf("  Retry Max Delay: %s", retryMaxDelay)
+	log.Printf("  Workers: %s", workers)
+	log.Printf("  Requests Per Second: %s", requestsPerSecond)
+	log.Printf("  Cache Dir: %s", cacheDir)
+	log.Printf("  Force Refresh: %s", forceRefresh)
+	log.Printf("  History Dir: %s", historyDir)
+	log.Printf("  History Keep Runs: %s", historyKeepRuns)
+	if apiURL != "" || accountsURL != "" {
+		log.Printf("  API URL: %s", apiURL)
+		log.Printf("  Accounts URL: %s", accountsURL)
+	}
+
+	// Validate the auth flow, defaulting to the classic authorization code flow
+	switch authFlow {
+	case "":
+		authFlow = AuthFlowCode
+	case AuthFlowCode, AuthFlowPKCE:
+	default:
+		return nil, fmt.Errorf("invalid auth flow %q (expected %q or %q)", authFlow, AuthFlowCode, AuthFlowPKCE)
+	}
 
 	// Validate required variables
-	if clientID == "" || clientSecret == "" || redirectURI == "" || port == "" ||
-		topTracksPattern == "" || startYear == "" || endYear == "" {
+	if clientID == "" || redirectURI == "" || port == "" || startYear == "" || endYear == "" {
 		return nil, fmt.Errorf("missing required environment variables")
 	}
 
+	// Top tracks playlists are identified by name patterns, playlist IDs or both
+	if topTracksPattern == "" && topTracksPatterns == "" && topTracksPlaylistIDs == "" {
+		return nil, fmt.Errorf("missing SPOTIFY_TOP_TRACKS_PATTERN, SPOTIFY_TOP_TRACKS_PATTERNS or SPOTIFY_TOP_TRACKS_PLAYLIST_IDS")
+	}
+
+	// The client secret is only needed for the classic authorization code flow
+	if authFlow == AuthFlowCode && clientSecret == "" {
+		return nil, fmt.Errorf("SPOTIFY_CLIENT_SECRET is required unless SPOTIFY_AUTH_FLOW=%s", AuthFlowPKCE)
+	}
+
 	// Convert port to integer
 	portNum, err := strconv.Atoi(port)
 	if err != nil {
 		return nil, fmt.Errorf("invalid port number: %v", err)
 	}
 
+	// Parse the alternate callback port range (e.g. "8082-8090")
+	var portRangeStart, portRangeEnd int
+	if portRange != "" {
+		portRangeStart, portRangeEnd, err = parsePortRange(portRange)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the range of years checked against the top tracks playlists
+	firstYear, lastYear, err := parseYearRange(startYear, endYear, time.Now().Year())
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile the top tracks playlist name patterns; the single pattern is kept for older configurations
+	patterns, err := parseTopTracksPatterns(strings.Join([]string{topTracksPattern, topTracksPatterns}, ";"))
+	if err != nil {
+		return nil, err
+	}
+	playlistIDs, err := parsePlaylistIDs(topTracksPlaylistIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compile the regular expression extracting the year from top tracks playlist names
+	if topTracksYearRegex == "" {
+		topTracksYearRegex = DefaultTopTracksYearRegex
+		log.Println("Using default top tracks year regex")
+	}
+	yearRegex, err := regexp.Compile(topTracksYearRegex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid top tracks year regex: %v", err)
+	}
+	if yearRegex.NumSubexp() == 0 {
+		return nil, fmt.Errorf("top tracks year regex %q needs a capture group for the year", topTracksYearRegex)
+	}
+
+	// Parse the track matching strategies, tried in the given order
+	if matchStrategies == "" {
+		matchStrategies = strings.Join(match.DefaultStrategies, ",")
+		log.Printf("Using default match strategies: %s", matchStrategies)
+	}
+	strategies, err := match.ParseStrategies(matchStrategies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SPOTIFY_MATCH_STRATEGIES: %v", err)
+	}
+
+	// Parse the fuzzy matching settings; near matches need a score of at least the threshold
+	threshold := 0.85
+	if fuzzyThreshold != "" {
+		threshold, err = strconv.ParseFloat(fuzzyThreshold, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return nil, fmt.Errorf("invalid fuzzy threshold value: %s (expected a number above 0 and at most 1)", fuzzyThreshold)
+		}
+	}
+	durationTolerance, err := parseDuration("SPOTIFY_FUZZY_DURATION_TOLERANCE", fuzzyDurationTolerance, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set default match decisions file if not specified
+	if matchDecisionsFile == "" {
+		matchDecisionsFile = "match_decisions.json"
+		log.Println("Using default match decisions file")
+	}
+
+	// Set default release year overrides file if not specified; the file is optional
+	if releaseYearOverrides == "" {
+		releaseYearOverrides = "release_year_overrides.csv"
+		log.Println("Using default release year overrides file")
+	}
+
 	// Parse overwrite files setting with explicit logging
 	var overwriteFilesBool bool
 	switch strings.ToLower(overwriteFiles) {
@@ -99,6 +319,83 @@ func LoadConfig() (*Config, error) {
 		log.Println("Using default log keep files count")
 	}
 
+	// Parse the number of login attempts allowed before giving up
+	maxAttempts := 3
+	if authMaxAttempts != "" {
+		maxAttempts, err = strconv.Atoi(authMaxAttempts)
+		if err != nil || maxAttempts < 1 {
+			return nil, fmt.Errorf("invalid auth max attempts value: %s", authMaxAttempts)
+		}
+	}
+
+	// Set default token store path if not specified
+	if tokenFile == "" {
+		tokenFile = "tokens/spotify-token.json"
+		log.Println("Using default token file path")
+	}
+
+	// Parse the named accounts to analyze, if more than one
+	accountNames, err := parseAccounts(accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the retry settings for failed API requests
+	retries := 5
+	if maxRetries != "" {
+		retries, err = strconv.Atoi(maxRetries)
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid max retries value: %s", maxRetries)
+		}
+	}
+	baseDelay, err := parseDuration("SPOTIFY_RETRY_BASE_DELAY", retryBaseDelay, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxDelay, err := parseDuration("SPOTIFY_RETRY_MAX_DELAY", retryMaxDelay, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if baseDelay > maxDelay {
+		return nil, fmt.Errorf("SPOTIFY_RETRY_BASE_DELAY (%s) must not exceed SPOTIFY_RETRY_MAX_DELAY (%s)", baseDelay, maxDelay)
+	}
+
+	// Parse the number of playlists fetched concurrently and the shared request rate
+	workerCount := 4
+	if workers != "" {
+		workerCount, err = strconv.Atoi(workers)
+		if err != nil || workerCount < 1 {
+			return nil, fmt.Errorf("invalid workers value: %s", workers)
+		}
+	}
+	perSecond := 10.0
+	if requestsPerSecond != "" {
+		perSecond, err = strconv.ParseFloat(requestsPerSecond, 64)
+		if err != nil || perSecond < 0 {
+			return nil, fmt.Errorf("invalid requests per second value: %s", requestsPerSecond)
+		}
+	}
+
+	// Set default cache directory if not specified; an empty value disables the cache
+	if !cacheDirSet {
+		cacheDir = "cache"
+		log.Println("Using default cache directory")
+	}
+
+	// Set default run history directory if not specified; an empty value disables change reports
+	if !historyDirSet {
+		historyDir = "history"
+		log.Println("Using default history directory")
+	}
+	// Parse the number of saved runs to keep; 0 keeps every run
+	keepRuns := 30
+	if historyKeepRuns != "" {
+		keepRuns, err = strconv.Atoi(historyKeepRuns)
+		if err != nil || keepRuns < 0 {
+			return nil, fmt.Errorf("invalid history keep runs value: %s", historyKeepRuns)
+		}
+	}
+
 	// Convert log keep files to integer
 	keepFiles, err := strconv.Atoi(logKeepFiles)
 	if err != nil {
@@ -106,17 +403,229 @@ func LoadConfig() (*Config, error) {
 	}
 
 	return &Config{
-		ClientID:              clientID,
-		ClientSecret:          clientSecret,
-		RedirectURI:           redirectURI,
-		Port:                  portNum,
-		TopTracksPattern:      topTracksPattern,
-		StartYear:             startYear,
-		EndYear:               endYear,
-		IncludeOtherPlaylists: includeOtherPlaylists == "true",
-		OverwriteFiles:        overwriteFilesBool,
-		LogFile:               logFile,
-		LogRotateSize:         logRotateSize,
-		LogKeepFiles:          keepFiles,
+		ClientID:                clientID,
+		ClientSecret:            clientSecret,
+		AuthFlow:                authFlow,
+		Headless:                strings.ToLower(headless) == "true",
+		AuthMaxAttempts:         maxAttempts,
+		RedirectURI:             redirectURI,
+		Port:                    portNum,
+		PortRangeStart:          portRangeStart,
+		PortRangeEnd:            portRangeEnd,
+		AllowRedirectPortChange: strings.ToLower(allowRedirectPortChange) == "true",
+		KillPortOwner:           strings.ToLower(killPortOwner) == "true",
+		TopTracksPatterns:       patterns,
+		TopTracksPlaylistIDs:    playlistIDs,
+		TopTracksYearRegex:      yearRegex,
+		MatchStrategies:         strategies,
+		FuzzyMatch:              strings.ToLower(fuzzyMatch) == "true",
+		FuzzyThreshold:          threshold,
+		FuzzyDurationTolerance:  durationTolerance,
+		MatchDecisionsFile:      matchDecisionsFile,
+		ReleaseYearOverrides:    releaseYearOverrides,
+		EarliestISRCYear:        strings.ToLower(earliestISRCYear) == "true",
+		Market:                  market,
+		MatchNonMusic:           strings.ToLower(matchNonMusic) == "true",
+		StartYear:               firstYear,
+		EndYear:                 lastYear,
+		IncludeOtherPlaylists:   includeOtherPlaylists == "true",
+		IncludeLikedSongs:       strings.ToLower(includeLikedSongs) == "true",
+		IncludeSavedAlbums:      strings.ToLower(includeSavedAlbums) == "true",
+		ListeningReport:         strings.ToLower(listeningReport) == "true",
+		StreamingHistoryDir:     streamingHistoryDir,
+		Suggestions:             strings.ToLower(suggestions) == "true",
+		OverwriteFiles:          overwriteFilesBool,
+		LogFile:                 logFile,
+		LogRotateSize:           logRotateSize,
+		LogKeepFiles:            keepFiles,
+		TokenFile:               tokenFile,
+		TokenKey:                tokenKey,
+		Accounts:                accountNames,
+		APIURL:                  apiURL,
+		AccountsURL:             accountsURL,
+		MaxRetries:              retries,
+		RetryBaseDelay:          baseDelay,
+		RetryMaxDelay:           maxDelay,
+		Workers:                 workerCount,
+		RequestsPerSecond:       perSecond,
+		CacheDir:                cacheDir,
+		ForceRefresh:            strings.ToLower(forceRefresh) == "true",
+		HistoryDir:              historyDir,
+		HistoryKeepRuns:         keepRuns,
 	}, nil
 }
+
+// ForAccount returns a copy of the configuration for a named account, with its own
+// token file, match decisions and run history
+func (c *Config) ForAccount(name string) *Config {
+	acct := *c
+	acct.Account = name
+	acct.TokenFile = accountFile(c.TokenFile, name)
+	acct.MatchDecisionsFile = accountFile(c.MatchDecisionsFile, name)
+	if c.HistoryDir != "" {
+		acct.HistoryDir = filepath.Join(c.HistoryDir, name)
+	}
+	// Each account has its own data export
+	if c.StreamingHistoryDir != "" {
+		acct.StreamingHistoryDir = filepath.Join(c.StreamingHistoryDir, name)
+	}
+	return &acct
+}
+
+// parseYearRange parses the first and last year of the range. Both must be whole
+// years from the earliest plausible release year to next year, and the first must
+// not come after the last.
+func parseYearRange(start, end string, currentYear int) (int, int, error) {
+	first, err := strconv.Atoi(strings.TrimSpace(start))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid SPOTIFY_START_YEAR value: %s", start)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(end))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid SPOTIFY_END_YEAR value: %s", end)
+	}
+	for _, year := range []int{first, last} {
+		if year < releaseyear.MinYear || year > currentYear+1 {
+			return 0, 0, fmt.Errorf("year %d is out of range (expected %d to %d)", year, releaseyear.MinYear, currentYear+1)
+		}
+	}
+	if first > last {
+		return 0, 0, fmt.Errorf("SPOTIFY_START_YEAR (%d) must not be after SPOTIFY_END_YEAR (%d)", first, last)
+	}
+	return first, last, nil
+}
+
+// accountFile inserts an account name before the extension of a file path
+func accountFile(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// parseTopTracksPatterns parses a semicolon-separated list of playlist name patterns
+// into case-insensitive regular expressions. A pattern is a regular expression if
+// prefixed with "regex:", a wildcard pattern matching the whole name (with * and ?)
+// if prefixed with "glob:", and otherwise a substring of the name.
+func parseTopTracksPatterns(value string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, pattern := range strings.Split(value, ";") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+
+		var expr string
+		switch {
+		case strings.HasPrefix(pattern, "regex:"):
+			expr = strings.TrimPrefix(pattern, "regex:")
+		case strings.HasPrefix(pattern, "glob:"):
+			expr = globToRegex(strings.TrimPrefix(pattern, "glob:"))
+		default:
+			expr = regexp.QuoteMeta(pattern)
+		}
+
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid top tracks pattern %q: %v", pattern, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// globToRegex converts a wildcard pattern to a regular expression matching the whole string
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// parsePlaylistIDs parses a comma-separated list of playlist IDs, each optionally
+// followed by ":year" to set the year of a playlist whose name has none
+func parsePlaylistIDs(value string) (map[string]string, error) {
+	ids := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, year := entry, ""
+		if i := strings.Index(entry, ":"); i >= 0 {
+			id, year = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			if _, err := strconv.Atoi(year); err != nil || len(year) != 4 {
+				return nil, fmt.Errorf("invalid year in top tracks playlist ID %q", entry)
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("invalid top tracks playlist ID %q", entry)
+		}
+		ids[id] = year
+	}
+	return ids, nil
+}
+
+// parseAccounts parses a comma-separated list of account names
+func parseAccounts(value string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// Account names are used in file names
+		for _, r := range name {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return nil, fmt.Errorf("invalid account name %q (use letters, digits, '-' and '_')", name)
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate account name %q", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// parseDuration parses a duration such as "500ms" or "2s", returning def if value is empty
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s value: %s", name, value)
+	}
+	return d, nil
+}
+
+// parsePortRange parses a port range of the form "start-end"
+func parsePortRange(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q (expected start-end)", value)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range start: %v", err)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range end: %v", err)
+	}
+	if start < 1 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return start, end, nil
+}
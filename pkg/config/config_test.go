@@ -0,0 +1,141 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTopTracksPatterns(t *testing.T) {
+	patterns, err := parseTopTracksPatterns("my top tracks of; glob:Top ?? of *;regex:^best of (?P<year>\\d{4})$;")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(patterns) != 3 {
+		t.Fatalf("expected 3 patterns, got %d", len(patterns))
+	}
+
+	tests := []struct {
+		pattern int
+		name    string
+		want    bool
+	}{
+		{0, "2021: My Top Tracks of the year", true},
+		{0, "My Top Tracks", false},
+		{1, "top 50 of 2021", true},
+		{1, "My top 50 of 2021", false},
+		{2, "Best of 2021", true},
+		{2, "Best of 2021 (remix)", false},
+	}
+	for _, test := range tests {
+		if got := patterns[test.pattern].MatchString(test.name); got != test.want {
+			t.Errorf("pattern %d matching %q = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+
+	if _, err := parseTopTracksPatterns("regex:(unclosed"); err == nil {
+		t.Error("expected an invalid regular expression to be rejected")
+	}
+}
+
+func TestParsePlaylistIDs(t *testing.T) {
+	ids, err := parsePlaylistIDs("abc, def:2021 ,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ids) != 2 || ids["abc"] != "" || ids["def"] != "2021" {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+
+	for _, value := range []string{"abc:21", ":2021", "abc:year"} {
+		if _, err := parsePlaylistIDs(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestParseYearRange(t *testing.T) {
+	first, last, err := parseYearRange(" 2020", "2025 ", 2026)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != 2020 || last != 2025 {
+		t.Errorf("expected 2020 to 2025, got %d to %d", first, last)
+	}
+
+	for _, years := range [][2]string{{"2020", "twenty"}, {"", "2025"}, {"2025", "2020"}, {"1850", "2020"}, {"2020", "2030"}} {
+		if _, _, err := parseYearRange(years[0], years[1], 2026); err == nil {
+			t.Errorf("expected %s to %s to be rejected", years[0], years[1])
+		}
+	}
+}
+
+func TestParseAccounts(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"", "", ""},
+		{"alice", "alice", ""},
+		{" alice , bob_2,carol-x ", "alice|bob_2|carol-x", ""},
+		{"alice,,bob, ", "alice|bob", ""},
+		{"alice,bob,alice", "", "duplicate account name"},
+		{"alice,bob smith", "", "invalid account name"},
+		{"../alice", "", "invalid account name"},
+		{"alice,bób", "", "invalid account name"},
+	}
+	for _, test := range tests {
+		names, err := parseAccounts(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil || strings.Join(names, "|") != test.want {
+			t.Errorf("%q: expected %q, got %q (%v)", test.value, test.want, strings.Join(names, "|"), err)
+		}
+	}
+}
+
+func TestForAccount(t *testing.T) {
+	cfg := &Config{
+		TokenFile:           "tokens/spotify-token.json",
+		MatchDecisionsFile:  "match_decisions.json",
+		HistoryDir:          "history",
+		StreamingHistoryDir: "export",
+		CacheDir:            "cache",
+	}
+
+	paths := make(map[string]string)
+	for _, name := range []string{"alice", "bob"} {
+		acct := cfg.ForAccount(name)
+		want := []string{
+			filepath.Join("tokens", "spotify-token-"+name+".json"),
+			"match_decisions-" + name + ".json",
+			filepath.Join("history", name),
+			filepath.Join("export", name),
+		}
+		got := []string{acct.TokenFile, acct.MatchDecisionsFile, acct.HistoryDir, acct.StreamingHistoryDir}
+		if acct.Account != name || strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: expected %v, got %s %v", name, want, acct.Account, got)
+		}
+		// No two accounts share a file
+		for _, path := range got {
+			if other, taken := paths[path]; taken {
+				t.Errorf("%s and %s share %s", other, name, path)
+			}
+			paths[path] = name
+		}
+	}
+
+	// The original configuration is left alone, and disabled features stay disabled
+	if cfg.TokenFile != "tokens/spotify-token.json" || cfg.Account != "" {
+		t.Errorf("expected the configuration to be unchanged, got %+v", cfg)
+	}
+	cfg.HistoryDir, cfg.StreamingHistoryDir = "", ""
+	if acct := cfg.ForAccount("alice"); acct.HistoryDir != "" || acct.StreamingHistoryDir != "" {
+		t.Errorf("expected disabled directories to stay empty, got %q and %q", acct.HistoryDir, acct.StreamingHistoryDir)
+	}
+}
@@ -17,6 +17,9 @@ type Config struct {
 	KeepFiles  int
 }
 
+// logFile is the currently open log file, closed by Close
+var logFile *os.File
+
 // InitLogger initializes the logger with file output
 func InitLogger(cfg *Config) error {
 	// Create logs directory if it doesn't exist
@@ -33,13 +36,32 @@ func InitLogger(cfg *Config) error {
 	// Set up multi-writer to write to both file and stdout
 	multiWriter := io.MultiWriter(os.Stdout, file)
 
-	// Configure logger
+	// Configure logger, closing any log file opened before
 	log.SetOutput(multiWriter)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
 
 	return nil
 }
 
+// Close flushes and closes the log file. Later log messages only go to stdout.
+func Close() error {
+	if logFile == nil {
+		return nil
+	}
+	log.SetOutput(os.Stdout)
+	file := logFile
+	logFile = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to flush log file: %v", err)
+	}
+	return file.Close()
+}
+
 // RotateLog rotates the log file if it exceeds the size limit
 func RotateLog(cfg *Config) error {
 	// Check if file exists and get its size
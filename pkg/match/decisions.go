@@ -0,0 +1,192 @@
+package match
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/atomicfile"
+)
+
+// Review decisions for a possible match
+const (
+	DecisionConfirm = "confirm"
+	DecisionReject  = "reject"
+)
+
+// ReviewHeaders are the columns of the review file listing possible matches. The
+// Decision, Track ID and Candidate ID columns are read back by ImportReview.
+var ReviewHeaders = []string{
+	"Decision", "Playlist", "Track Name", "Artist(s)", "Duration",
+	"Top Tracks Playlist", "Candidate Name", "Candidate Artist(s)", "Candidate Duration",
+	"Score", "Track ID", "Candidate ID",
+}
+
+// Decision records whether a possible match was confirmed or rejected
+type Decision struct {
+	TrackID     string    `json:"track_id"`
+	CandidateID string    `json:"candidate_id"`
+	Track       string    `json:"track,omitempty"`
+	Candidate   string    `json:"candidate,omitempty"`
+	Decision    string    `json:"decision"`
+	DecidedAt   time.Time `json:"decided_at"`
+}
+
+// Decisions holds the review decisions saved in a file
+type Decisions struct {
+	path    string
+	entries map[string]Decision
+}
+
+// decisionsFile is the on-disk representation of the decisions
+type decisionsFile struct {
+	Decisions []Decision `json:"decisions"`
+}
+
+// LoadDecisions reads the decisions saved in path. A missing file holds no decisions.
+func LoadDecisions(path string) (*Decisions, error) {
+	d := &Decisions{path: path, entries: make(map[string]Decision)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read match decisions: %v", err)
+	}
+
+	var file decisionsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse match decisions %s: %v", path, err)
+	}
+	for _, decision := range file.Decisions {
+		d.entries[pairKey(decision.TrackID, decision.CandidateID)] = decision
+	}
+	return d, nil
+}
+
+// Get returns the decision made for a track and a candidate, or an empty string if there is none
+func (d *Decisions) Get(track, candidate Track) string {
+	if d == nil {
+		return ""
+	}
+	return d.entries[pairKey(Identity(track), Identity(candidate))].Decision
+}
+
+// Len returns the number of decisions
+func (d *Decisions) Len() int {
+	return len(d.entries)
+}
+
+// ImportReview reads the decisions filled in the Decision column of a review file
+// and returns how many were added or changed. A missing review file is not an error.
+func (d *Decisions) ImportReview(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read match review: %v", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(string(data), "\ufeff"))).ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse match review %s: %v", path, err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	columns := make(map[string]int)
+	for i, header := range rows[0] {
+		columns[header] = i
+	}
+	for _, name := range []string{"Decision", "Track ID", "Candidate ID"} {
+		if _, exists := columns[name]; !exists {
+			return 0, fmt.Errorf("match review %s has no %s column", path, name)
+		}
+	}
+	value := func(row []string, name string) string {
+		if i, exists := columns[name]; exists && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	imported := 0
+	for _, row := range rows[1:] {
+		decision := strings.ToLower(value(row, "Decision"))
+		if decision == "" {
+			continue
+		}
+		if decision != DecisionConfirm && decision != DecisionReject {
+			log.Printf("Warning: ignoring unknown decision %q for %s in %s (expected %s or %s)",
+				decision, value(row, "Track Name"), path, DecisionConfirm, DecisionReject)
+			continue
+		}
+
+		key := pairKey(value(row, "Track ID"), value(row, "Candidate ID"))
+		if d.entries[key].Decision == decision {
+			continue
+		}
+		d.entries[key] = Decision{
+			TrackID:     value(row, "Track ID"),
+			CandidateID: value(row, "Candidate ID"),
+			Track:       value(row, "Track Name"),
+			Candidate:   value(row, "Candidate Name"),
+			Decision:    decision,
+			DecidedAt:   time.Now().UTC(),
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// Save writes the decisions to their file
+func (d *Decisions) Save() error {
+	file := decisionsFile{Decisions: make([]Decision, 0, len(d.entries))}
+	for _, decision := range d.entries {
+		file.Decisions = append(file.Decisions, decision)
+	}
+	// Keep the file stable between runs so it is easy to compare and edit
+	sort.Slice(file.Decisions, func(i, j int) bool {
+		a, b := file.Decisions[i], file.Decisions[j]
+		return pairKey(a.TrackID, a.CandidateID) < pairKey(b.TrackID, b.CandidateID)
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode match decisions: %v", err)
+	}
+	if dir := filepath.Dir(d.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create match decisions directory: %v", err)
+		}
+	}
+
+	if err := atomicfile.WriteFile(d.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to save match decisions: %v", err)
+	}
+	return nil
+}
+
+// Identity identifies a track in the review file and the decisions: its track ID,
+// or its title and primary artist for local files, which have no ID
+func Identity(track Track) string {
+	if track.ID != "" {
+		return track.ID
+	}
+	if key := Key(StrategyTitleArtist, track); key != "" {
+		return "local:" + key
+	}
+	return ""
+}
+
+// pairKey identifies a track and candidate pair
+func pairKey(trackID, candidateID string) string {
+	return trackID + "\x00" + candidateID
+}
@@ -0,0 +1,151 @@
+package match
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Weights of the title and primary artist in a fuzzy match score
+const (
+	titleWeight  = 0.7
+	artistWeight = 0.3
+)
+
+// Candidate is an indexed track that is similar to a given track
+type Candidate struct {
+	Track  Track
+	Values []string
+	Score  float64
+}
+
+// Closest returns the indexed track most similar to track, if its score is at least
+// threshold. Tracks whose durations differ by more than tolerance are never
+// candidates; a zero tolerance ignores durations. Tracks for which exclude returns
+// true are skipped, so a rejected candidate can give way to the next best one.
+func (ix *Index) Closest(track Track, threshold float64, tolerance time.Duration, exclude func(Track) bool) (Candidate, bool) {
+	if ix == nil {
+		return Candidate{}, false
+	}
+
+	var best Candidate
+	for _, entry := range ix.list {
+		if tolerance > 0 && track.Duration > 0 && entry.track.Duration > 0 {
+			diff := track.Duration - entry.track.Duration
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff > tolerance {
+				continue
+			}
+		}
+		if exclude != nil && exclude(entry.track) {
+			continue
+		}
+		score := Similarity(track, entry.track)
+		if score > best.Score {
+			best = Candidate{Track: entry.track, Values: entry.values, Score: score}
+		}
+	}
+	if best.Score == 0 || best.Score < threshold {
+		return Candidate{}, false
+	}
+	return best, true
+}
+
+// Similarity scores how alike two tracks are from 0 to 1, using the token set
+// similarity of their normalized titles and of their primary artists
+func Similarity(a, b Track) float64 {
+	title := TokenSetSimilarity(NormalizeTitle(a.Title), NormalizeTitle(b.Title))
+	artist := 0.0
+	if len(a.Artists) > 0 && len(b.Artists) > 0 {
+		artist = TokenSetSimilarity(normalize(a.Artists[0]), normalize(b.Artists[0]))
+	}
+	return titleWeight*title + artistWeight*artist
+}
+
+// TokenSetSimilarity compares two strings as sets of words, ignoring word order and
+// repeated words. The words both strings share are compared with each string's
+// full set of words, so "love story" and "love story taylors version" are similar,
+// and the closest of the comparisons is returned as a value from 0 to 1.
+func TokenSetSimilarity(a, b string) float64 {
+	setA, setB := tokenSet(a), tokenSet(b)
+	if len(setA) == 0 || len(setB) == 0 {
+		return 0
+	}
+
+	var common, onlyA, onlyB []string
+	for token := range setA {
+		if setB[token] {
+			common = append(common, token)
+		} else {
+			onlyA = append(onlyA, token)
+		}
+	}
+	for token := range setB {
+		if !setA[token] {
+			onlyB = append(onlyB, token)
+		}
+	}
+	sort.Strings(common)
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+
+	shared := strings.Join(common, " ")
+	fullA := strings.TrimSpace(shared + " " + strings.Join(onlyA, " "))
+	fullB := strings.TrimSpace(shared + " " + strings.Join(onlyB, " "))
+
+	best := ratio(fullA, fullB)
+	if shared != "" {
+		if r := ratio(shared, fullA); r > best {
+			best = r
+		}
+		if r := ratio(shared, fullB); r > best {
+			best = r
+		}
+	}
+	return best
+}
+
+// tokenSet returns the set of words in s
+func tokenSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, token := range strings.Fields(s) {
+		set[token] = true
+	}
+	return set
+}
+
+// ratio returns the edit distance similarity of two strings from 0 to 1
+func ratio(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein returns the number of single character edits turning a into b
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
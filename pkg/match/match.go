@@ -0,0 +1,223 @@
+// Package match decides whether two Spotify tracks are the same song. The same
+// recording often exists under several track IDs, for example on a single, an
+// album and a deluxe edition, so tracks are matched with a list of strategies
+// tried in order: the track ID, the ISRC recording code, and the normalized title
+// and primary artist.
+package match
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/zmb3/spotify"
+)
+
+// Matching strategies
+const (
+	StrategyID          = "id"
+	StrategyISRC        = "isrc"
+	StrategyTitleArtist = "title_artist"
+	// StrategyFuzzy is reported for near matches found by Closest; it is enabled
+	// separately instead of being listed with the other strategies
+	StrategyFuzzy = "fuzzy"
+)
+
+// DefaultStrategies are used when none are configured, from the most to the least exact
+var DefaultStrategies = []string{StrategyID, StrategyISRC, StrategyTitleArtist}
+
+// ParseStrategies parses a comma-separated list of strategies, keeping their order
+func ParseStrategies(value string) ([]string, error) {
+	var strategies []string
+	seen := make(map[string]bool)
+	for _, strategy := range strings.Split(value, ",") {
+		strategy = strings.ToLower(strings.TrimSpace(strategy))
+		if strategy == "" || seen[strategy] {
+			continue
+		}
+		switch strategy {
+		case StrategyID, StrategyISRC, StrategyTitleArtist:
+		default:
+			return nil, fmt.Errorf("unknown match strategy %q (expected %s, %s or %s)",
+				strategy, StrategyID, StrategyISRC, StrategyTitleArtist)
+		}
+		seen[strategy] = true
+		strategies = append(strategies, strategy)
+	}
+	if len(strategies) == 0 {
+		return nil, fmt.Errorf("no match strategies given")
+	}
+	return strategies, nil
+}
+
+// Track holds the fields of a track used for matching
+type Track struct {
+	ID       string
+	ISRC     string
+	Title    string
+	Artists  []string
+	Duration time.Duration
+}
+
+// FromSpotify returns the matching fields of a Spotify track
+func FromSpotify(track spotify.FullTrack) Track {
+	artists := make([]string, 0, len(track.Artists))
+	for _, artist := range track.Artists {
+		artists = append(artists, artist.Name)
+	}
+	return Track{
+		ID:       string(track.ID),
+		ISRC:     strings.ToUpper(strings.TrimSpace(track.ExternalIDs["isrc"])),
+		Title:    track.Name,
+		Artists:  artists,
+		Duration: track.TimeDuration(),
+	}
+}
+
+// Key returns the key identifying a track under a strategy, or an empty string if
+// the track lacks the fields the strategy needs
+func Key(strategy string, track Track) string {
+	switch strategy {
+	case StrategyID:
+		return track.ID
+	case StrategyISRC:
+		return track.ISRC
+	case StrategyTitleArtist:
+		if len(track.Artists) == 0 {
+			return ""
+		}
+		title, artist := NormalizeTitle(track.Title), normalize(track.Artists[0])
+		if title == "" || artist == "" {
+			return ""
+		}
+		return title + "|" + artist
+	}
+	return ""
+}
+
+// versionPattern finds bracketed or dashed suffixes that name a version of the same
+// recording rather than a different song, such as "(Remastered 2011)",
+// "[feat. Someone]" or " - Single Version"
+var versionPattern = regexp.MustCompile(`(?i)\s*(\([^)]*\b(remaster|remastered|feat|ft|featuring|with|deluxe|bonus|single|album|explicit|clean|mono|stereo)\b[^)]*\)|\[[^\]]*\b(remaster|remastered|feat|ft|featuring|with|deluxe|bonus|single|album|explicit|clean|mono|stereo)\b[^\]]*\]|\s-\s.*\b(remaster|remastered|deluxe|bonus|single|album|explicit|clean|mono|stereo)\b.*$)`)
+
+// featuringPattern finds a featured artist credit outside brackets, such as "Song feat. Someone"
+var featuringPattern = regexp.MustCompile(`(?i)\s+(feat\.?|ft\.|featuring)\s.*$`)
+
+// NormalizeTitle reduces a track title to the words that identify the song: version
+// suffixes and featured artists are removed, and case and punctuation are ignored
+func NormalizeTitle(title string) string {
+	title = versionPattern.ReplaceAllString(title, "")
+	title = featuringPattern.ReplaceAllString(title, "")
+	return normalize(title)
+}
+
+// NormalizeArtist reduces an artist name to its words, ignoring case and punctuation
+func NormalizeArtist(name string) string {
+	return normalize(name)
+}
+
+// normalize lowercases a string, spells out "&" and keeps only letters and digits,
+// with single spaces between words
+func normalize(s string) string {
+	s = strings.ReplaceAll(strings.ToLower(s), "&", " and ")
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case r == '\'' || r == '’':
+			// "Don't" and "Dont" are the same title
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// Index finds tracks that match a given track, and the values stored for them
+type Index struct {
+	strategies []string
+	entries    map[string]map[string][]string
+	// list holds each distinct track once, for fuzzy matching
+	list   []indexEntry
+	tracks map[string]int
+}
+
+// indexEntry is a distinct indexed track and the values stored for it
+type indexEntry struct {
+	track  Track
+	values []string
+}
+
+// NewIndex creates an empty index using strategies in the given order
+func NewIndex(strategies []string) *Index {
+	entries := make(map[string]map[string][]string, len(strategies))
+	for _, strategy := range strategies {
+		entries[strategy] = make(map[string][]string)
+	}
+	return &Index{strategies: strategies, entries: entries, tracks: make(map[string]int)}
+}
+
+// Add stores a value, such as the name of the playlist a track is in, under every key of the track
+func (ix *Index) Add(track Track, value string) {
+	identity := ""
+	for _, strategy := range ix.strategies {
+		key := Key(strategy, track)
+		if key == "" {
+			continue
+		}
+		if identity == "" {
+			identity = strategy + ":" + key
+		}
+		ix.entries[strategy][key] = AppendUnique(ix.entries[strategy][key], value)
+	}
+	if identity == "" {
+		return
+	}
+	i, exists := ix.tracks[identity]
+	if !exists {
+		i = len(ix.list)
+		ix.tracks[identity] = i
+		ix.list = append(ix.list, indexEntry{track: track})
+	}
+	ix.list[i].values = AppendUnique(ix.list[i].values, value)
+}
+
+// Lookup returns the values stored for the first strategy under which the track
+// matches an indexed track, and the name of that strategy. It returns no values
+// and an empty strategy if nothing matches. A nil index matches nothing.
+func (ix *Index) Lookup(track Track) ([]string, string) {
+	if ix == nil {
+		return nil, ""
+	}
+	for _, strategy := range ix.strategies {
+		key := Key(strategy, track)
+		if key == "" {
+			continue
+		}
+		if values, exists := ix.entries[strategy][key]; exists {
+			return values, strategy
+		}
+	}
+	return nil, ""
+}
+
+// Len returns the number of distinct tracks added, identified by their first available key
+func (ix *Index) Len() int {
+	if ix == nil {
+		return 0
+	}
+	return len(ix.list)
+}
+
+// AppendUnique appends value to values unless it is already present
+func AppendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,202 @@
+package match
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStrategies(t *testing.T) {
+	strategies, err := ParseStrategies(" ISRC, id,isrc ,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(strategies) != 2 || strategies[0] != StrategyISRC || strategies[1] != StrategyID {
+		t.Errorf("unexpected strategies: %v", strategies)
+	}
+
+	for _, value := range []string{"", " , ", "id,fuzzy"} {
+		if _, err := ParseStrategies(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := map[string]string{
+		"Golden Hour":                        "golden hour",
+		"Golden Hour - Remastered 2011":      "golden hour",
+		"Golden Hour (2021 Remaster)":        "golden hour",
+		"Golden Hour [feat. Someone]":        "golden hour",
+		"Golden Hour (with Someone & Other)": "golden hour",
+		"Golden Hour feat. Someone":          "golden hour",
+		"Golden Hour - Single Version":       "golden hour",
+		"Don’t Stop (Deluxe Edition)":        "dont stop",
+		"Rock & Roll":                        "rock and roll",
+		"Golden Hour - Live at Wembley":      "golden hour live at wembley",
+		"Golden Hour (Acoustic)":             "golden hour acoustic",
+		"Señorita":                           "señorita",
+	}
+	for title, want := range tests {
+		if got := NormalizeTitle(title); got != want {
+			t.Errorf("NormalizeTitle(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestIndexLookup(t *testing.T) {
+	original := Track{ID: "t1", ISRC: "USAAA1", Title: "Golden Hour", Artists: []string{"Alpha", "Beta"}}
+	index := NewIndex(DefaultStrategies)
+	index.Add(original, "Top 2021")
+	index.Add(original, "Top 2022")
+	index.Add(Track{ID: "t1", Title: "Golden Hour", Artists: []string{"Alpha"}}, "Top 2022")
+
+	tests := []struct {
+		name     string
+		track    Track
+		strategy string
+	}{
+		{"same ID", Track{ID: "t1"}, StrategyID},
+		{"same recording on another release", Track{ID: "t2", ISRC: "USAAA1", Title: "Golden Hour"}, StrategyISRC},
+		{"remaster", Track{ID: "t3", ISRC: "USBBB1", Title: "Golden Hour - 2015 Remaster", Artists: []string{"alpha"}}, StrategyTitleArtist},
+		{"other artist", Track{ID: "t4", Title: "Golden Hour", Artists: []string{"Gamma"}}, ""},
+		{"local file without artists", Track{Title: "Golden Hour"}, ""},
+	}
+	for _, test := range tests {
+		values, strategy := index.Lookup(test.track)
+		if strategy != test.strategy {
+			t.Errorf("%s: expected strategy %q, got %q", test.name, test.strategy, strategy)
+		}
+		if strategy != "" && len(values) != 2 {
+			t.Errorf("%s: expected both playlists, got %v", test.name, values)
+		}
+	}
+
+	if got := index.Len(); got != 1 {
+		t.Errorf("expected 1 distinct track, got %d", got)
+	}
+
+	// Only the configured strategies are used
+	idOnly := NewIndex([]string{StrategyID})
+	idOnly.Add(original, "Top 2021")
+	if _, strategy := idOnly.Lookup(Track{ID: "t2", ISRC: "USAAA1"}); strategy != "" {
+		t.Errorf("expected no match without the isrc strategy, got %q", strategy)
+	}
+
+	var missing *Index
+	if _, strategy := missing.Lookup(original); strategy != "" {
+		t.Errorf("expected a nil index to match nothing, got %q", strategy)
+	}
+}
+
+func TestAppendUnique(t *testing.T) {
+	var values []string
+	for _, value := range []string{"Road Trip", "Chill", "Road Trip", "road trip"} {
+		values = AppendUnique(values, value)
+	}
+	if got := strings.Join(values, "|"); got != "Road Trip|Chill|road trip" {
+		t.Errorf("unexpected values: %s", got)
+	}
+}
+
+func TestTokenSetSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{"love story", "love story", 1, 1},
+		{"love story", "story love", 1, 1},
+		{"love story", "love story taylors version", 1, 1},
+		{"golden hour", "goldn hour", 0.85, 0.95},
+		{"golden hour", "missing piece", 0, 0.3},
+		{"", "golden hour", 0, 0},
+	}
+	for _, test := range tests {
+		got := TokenSetSimilarity(test.a, test.b)
+		if got < test.min || got > test.max {
+			t.Errorf("TokenSetSimilarity(%q, %q) = %.2f, want between %.2f and %.2f", test.a, test.b, got, test.min, test.max)
+		}
+	}
+}
+
+func TestClosest(t *testing.T) {
+	original := Track{ID: "t1", Title: "Golden Hour", Artists: []string{"Alpha"}, Duration: 200 * time.Second}
+	other := Track{ID: "t2", Title: "Night Drive", Artists: []string{"Beta"}, Duration: 180 * time.Second}
+	index := NewIndex(DefaultStrategies)
+	index.Add(original, "Top 2021")
+	index.Add(other, "Top 2021")
+
+	rerecorded := Track{ID: "t3", Title: "Golden Hour (Alpha's Version)", Artists: []string{"Alpha"}, Duration: 205 * time.Second}
+	candidate, ok := index.Closest(rerecorded, 0.85, 10*time.Second, nil)
+	if !ok || candidate.Track.ID != "t1" || candidate.Score < 0.85 || len(candidate.Values) != 1 {
+		t.Fatalf("expected the original recording as candidate, got %+v, %v", candidate, ok)
+	}
+
+	if _, ok := index.Closest(rerecorded, 0.85, 2*time.Second, nil); ok {
+		t.Error("expected a duration outside the tolerance to rule out the candidate")
+	}
+	if _, ok := index.Closest(rerecorded, 0.85, 0, nil); !ok {
+		t.Error("expected a zero tolerance to ignore durations")
+	}
+	rejected := func(track Track) bool { return track.ID == "t1" }
+	if candidate, ok := index.Closest(rerecorded, 0.85, 10*time.Second, rejected); ok {
+		t.Errorf("expected no candidate once the original was rejected, got %+v", candidate)
+	}
+	if _, ok := index.Closest(Track{ID: "t4", Title: "Missing Piece", Artists: []string{"Gamma"}}, 0.85, 0, nil); ok {
+		t.Error("expected an unrelated track to have no candidate")
+	}
+}
+
+func TestDecisionsImportReview(t *testing.T) {
+	dir := t.TempDir()
+	review := filepath.Join(dir, "match_review.csv")
+	content := "\ufeff" + strings.Join(ReviewHeaders, ",") + "\n" +
+		"Confirm,Road Trip,Song A,Alpha,3:20,Top 2021,Song,Alpha,3:21,0.90,t1,c1\n" +
+		"reject,Road Trip,Song B,Beta,3:20,Top 2021,Song,Beta,3:21,0.88,t2,c2\n" +
+		",Road Trip,Song C,Gamma,3:20,Top 2021,Song,Gamma,3:21,0.87,t3,c3\n" +
+		"maybe,Road Trip,Song D,Delta,3:20,Top 2021,Song,Delta,3:21,0.86,t4,c4\n"
+	if err := os.WriteFile(review, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "decisions", "match_decisions.json")
+	decisions, err := LoadDecisions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := decisions.ImportReview(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported != 2 {
+		t.Errorf("expected 2 decisions imported, got %d", imported)
+	}
+	if err := decisions.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decisions survive a reload and importing the same review again changes nothing
+	reloaded, err := LoadDecisions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get(Track{ID: "t1"}, Track{ID: "c1"}); got != DecisionConfirm {
+		t.Errorf("expected t1 to be confirmed, got %q", got)
+	}
+	if got := reloaded.Get(Track{ID: "t2"}, Track{ID: "c2"}); got != DecisionReject {
+		t.Errorf("expected t2 to be rejected, got %q", got)
+	}
+	if got := reloaded.Get(Track{ID: "t3"}, Track{ID: "c3"}); got != "" {
+		t.Errorf("expected t3 to be undecided, got %q", got)
+	}
+	if imported, err := reloaded.ImportReview(review); err != nil || imported != 0 {
+		t.Errorf("expected nothing new to import, got %d, %v", imported, err)
+	}
+
+	if imported, err := reloaded.ImportReview(filepath.Join(dir, "missing.csv")); err != nil || imported != 0 {
+		t.Errorf("expected a missing review to be ignored, got %d, %v", imported, err)
+	}
+}
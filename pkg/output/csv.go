@@ -1,15 +1,26 @@
 package output
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/mikev/spotify-analysis/pkg/changes"
+	"github.com/mikev/spotify-analysis/pkg/match"
 	"github.com/mikev/spotify-analysis/pkg/processor"
+	"github.com/mikev/spotify-analysis/pkg/suggest"
 )
 
+// MatchReviewFile is the name of the file listing possible matches to review
+const MatchReviewFile = "match_review.csv"
+
 // CSVWriter handles writing track data to CSV files
 type CSVWriter struct {
 	outputDir string
@@ -28,81 +39,452 @@ func NewCSVWriter(outputDir string, overwrite bool) (*CSVWriter, error) {
 	}, nil
 }
 
-// WriteTracks writes track data to CSV files
-func (w *CSVWriter) WriteTracks(tracks map[string][]processor.TrackData) error {
+// WriteTracks writes track data to CSV files. Either all files are replaced or,
+// if writing fails or ctx is cancelled, none of them are.
+func (w *CSVWriter) WriteTracks(ctx context.Context, tracks map[string][]processor.TrackData) error {
 	// Write user tracks
-	if err := w.writeToCSV("user_playlists.csv", tracks["user"]); err != nil {
-		return err
-	}
+	files := []csvFile{trackFile("user_playlists.csv", tracks["user"])}
 
 	// Write other tracks if they exist
 	if len(tracks["other"]) > 0 {
-		if err := w.writeToCSV("other_playlists.csv", tracks["other"]); err != nil {
-			return err
-		}
+		files = append(files, trackFile("other_playlists.csv", tracks["other"]))
 	}
 
-	return nil
+	return w.writeFiles(ctx, files...)
+}
+
+// WriteFailedPlaylists writes the playlists that could not be processed, if any.
+// Without failures, the file left by an earlier run is removed.
+func (w *CSVWriter) WriteFailedPlaylists(ctx context.Context, failed []processor.FailedPlaylist) error {
+	if len(failed) == 0 {
+		return w.replaceFiles(ctx, nil, []string{"failed_playlists.csv"})
+	}
+	headers := []string{"Playlist", "Playlist ID", "Owner", "Error"}
+	rows := make([][]string, 0, len(failed))
+	for _, playlist := range failed {
+		rows = append(rows, []string{
+			playlist.PlaylistName,
+			playlist.PlaylistID,
+			playlist.Owner,
+			playlist.Error,
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: "failed_playlists.csv", headers: headers, rows: rows})
 }
 
-// writeToCSV writes track data to a specific CSV file
-func (w *CSVWriter) writeToCSV(filename string, tracks []processor.TrackData) error {
-	filepath := filepath.Join(w.outputDir, filename)
+// WritePlaylistSummary writes the number of tracks, episodes, local files and
+// unplayable items in each processed playlist
+func (w *CSVWriter) WritePlaylistSummary(ctx context.Context, summaries []processor.PlaylistSummary) error {
+	headers := []string{"Playlist", "Owner", "Items", "Tracks", "Episodes", "Local Files", "Unavailable", "Region Restricted"}
+	rows := make([][]string, 0, len(summaries))
+	for _, summary := range summaries {
+		rows = append(rows, []string{
+			summary.PlaylistName,
+			summary.Owner,
+			strconv.Itoa(summary.Items),
+			strconv.Itoa(summary.Tracks),
+			strconv.Itoa(summary.Episodes),
+			strconv.Itoa(summary.LocalFiles),
+			strconv.Itoa(summary.Unavailable),
+			strconv.Itoa(summary.RegionRestricted),
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: "playlist_summary.csv", headers: headers, rows: rows})
+}
 
-	// Check if file exists
-	if _, err := os.Stat(filepath); err == nil {
-		if !w.overwrite {
-			return fmt.Errorf("file %s already exists and overwrite is disabled", filename)
-		}
-		log.Printf("File %s already exists. Removing it...", filename)
-		if err := os.Remove(filepath); err != nil {
-			return fmt.Errorf("failed to remove existing file %s: %v", filename, err)
+// WriteDataQuality writes the malformed values found in the track data, if any.
+// Without issues, the file left by an earlier run is removed.
+func (w *CSVWriter) WriteDataQuality(ctx context.Context, issues []processor.DataIssue) error {
+	if len(issues) == 0 {
+		return w.replaceFiles(ctx, nil, []string{"data_quality.csv"})
+	}
+	headers := []string{"Playlist", "Track Name", "Track ID", "Field", "Value", "Problem"}
+	rows := make([][]string, 0, len(issues))
+	for _, issue := range issues {
+		rows = append(rows, []string{
+			issue.PlaylistName,
+			issue.TrackName,
+			issue.TrackID,
+			issue.Field,
+			issue.Value,
+			issue.Problem,
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: "data_quality.csv", headers: headers, rows: rows})
+}
+
+// WriteListeningReport writes the heavily played tracks missing from the top tracks
+// playlists, most played first
+func (w *CSVWriter) WriteListeningReport(ctx context.Context, report []processor.ListeningTrack) error {
+	headers := []string{"Track Name", "Artist(s)", "Album", "Release Year", "Score", "Short Term Rank", "Medium Term Rank", "Long Term Rank", "Recent Plays", "NotInTopTrackPlaylist", "Found In Top Tracks Playlist", "Match Strategy", "Match Score"}
+	rows := make([][]string, 0, len(report))
+	for _, track := range report {
+		rows = append(rows, []string{
+			track.TrackName,
+			track.Artists,
+			track.Album,
+			track.ReleaseYear,
+			strconv.Itoa(track.Score),
+			formatRank(track.ShortTermRank),
+			formatRank(track.MediumTermRank),
+			formatRank(track.LongTermRank),
+			strconv.Itoa(track.RecentPlays),
+			track.NotInTopTracks,
+			track.FoundInTopTracks,
+			track.MatchStrategy,
+			track.MatchScore,
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: "listening_report.csv", headers: headers, rows: rows})
+}
+
+// WriteSuggestions writes the ranked candidates for each year's top tracks playlist
+// to suggestions_<year>.csv and returns the names of the files written. Files of
+// years without candidates in this run are removed. The play count is left blank
+// without an imported streaming history.
+func (w *CSVWriter) WriteSuggestions(ctx context.Context, suggestions map[string][]suggest.Suggestion, withPlays bool) ([]string, error) {
+	headers := []string{"Rank", "Track Name", "Artist(s)", "Album", "Score", "Playlists", "Playlist Names", "First Added", "Play Count", "Artist In Top Tracks", "Track ID"}
+	years := make([]string, 0, len(suggestions))
+	for year := range suggestions {
+		years = append(years, year)
+	}
+	sort.Strings(years)
+
+	files := make([]csvFile, 0, len(years))
+	for _, year := range years {
+		rows := make([][]string, 0, len(suggestions[year]))
+		for _, suggestion := range suggestions[year] {
+			firstAdded, plays, artist := "", "", ""
+			if !suggestion.FirstAdded.IsZero() {
+				firstAdded = suggestion.FirstAdded.Format("2006-01-02")
+			}
+			if withPlays {
+				plays = strconv.Itoa(suggestion.Plays)
+			}
+			if suggestion.ArtistInTopTracks {
+				artist = "TRUE"
+			}
+			rows = append(rows, []string{
+				strconv.Itoa(suggestion.Rank),
+				suggestion.TrackName,
+				suggestion.Artists,
+				suggestion.Album,
+				strconv.FormatFloat(suggestion.Score, 'f', 1, 64),
+				strconv.Itoa(len(suggestion.Playlists)),
+				strings.Join(suggestion.Playlists, ", "),
+				firstAdded,
+				plays,
+				artist,
+				suggestion.TrackID,
+			})
 		}
+		files = append(files, csvFile{name: "suggestions_" + year + ".csv", headers: headers, rows: rows})
 	}
 
-	file, err := os.Create(filepath)
+	// Rankings of earlier runs must not sit next to the current ones
+	existing, err := filepath.Glob(filepath.Join(w.outputDir, "suggestions_*.csv"))
 	if err != nil {
-		return fmt.Errorf("failed to create file %s: %v", filename, err)
+		return nil, fmt.Errorf("failed to list suggestion files: %v", err)
+	}
+	written := make(map[string]bool)
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		written[file.name] = true
+		names = append(names, file.name)
+	}
+	var stale []string
+	for _, path := range existing {
+		if name := filepath.Base(path); !written[name] {
+			stale = append(stale, name)
+		}
 	}
-	defer file.Close()
 
-	// Add UTF-8 BOM for proper Excel encoding
-	file.Write([]byte{0xEF, 0xBB, 0xBF})
+	if err := w.replaceFiles(ctx, files, stale); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// formatRank formats a top tracks rank, leaving it blank for tracks outside the top tracks
+func formatRank(rank int) string {
+	if rank == 0 {
+		return ""
+	}
+	return strconv.Itoa(rank)
+}
 
-	// Write headers
-	headers := []string{"Playlist", "Track Name", "Artist(s)", "Album", "Release Date", "Release Year", "NotInTopTrackPlaylist"}
-	if err := writer.Write(headers); err != nil {
-		return fmt.Errorf("failed to write headers: %v", err)
+// WriteChanges writes the changes since the previous run
+func (w *CSVWriter) WriteChanges(ctx context.Context, list []changes.Change) error {
+	headers := []string{"Change", "Playlist", "Track Name", "Artist(s)", "Track ID"}
+	rows := make([][]string, 0, len(list))
+	for _, change := range list {
+		rows = append(rows, []string{
+			change.Type,
+			change.Playlist,
+			change.TrackName,
+			change.Artists,
+			change.TrackID,
+		})
 	}
+	return w.writeFiles(ctx, csvFile{name: "changes.csv", headers: headers, rows: rows})
+}
 
-	// Write track data with progress logging
-	totalTracks := len(tracks)
-	log.Printf("Writing %d tracks to %s...", totalTracks, filename)
+// WriteMatchReview writes the possible matches to review. Each row's Decision column
+// can be set to "confirm" or "reject"; the decisions are imported on the next run.
+func (w *CSVWriter) WriteMatchReview(ctx context.Context, matches []*processor.PossibleMatch) error {
+	rows := make([][]string, 0, len(matches))
+	for _, possible := range matches {
+		rows = append(rows, []string{
+			"",
+			strings.Join(possible.Playlists, ", "),
+			possible.Track.Title,
+			strings.Join(possible.Track.Artists, ", "),
+			formatDuration(possible.Track.Duration),
+			strings.Join(possible.Candidate.Values, ", "),
+			possible.Candidate.Track.Title,
+			strings.Join(possible.Candidate.Track.Artists, ", "),
+			formatDuration(possible.Candidate.Track.Duration),
+			strconv.FormatFloat(possible.Candidate.Score, 'f', 2, 64),
+			match.Identity(possible.Track),
+			match.Identity(possible.Candidate.Track),
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: MatchReviewFile, headers: match.ReviewHeaders, rows: rows})
+}
 
-	for i, track := range tracks {
-		row := []string{
+// formatDuration formats a track duration as minutes and seconds
+func formatDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	seconds := int(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// WriteCombinedReport writes the multi-account report of tracks missing from top tracks playlists
+func (w *CSVWriter) WriteCombinedReport(ctx context.Context, report []processor.CombinedTrack) error {
+	headers := []string{"Track Name", "Artist(s)", "Album", "Release Year", "Missing From", "In Top Tracks Of"}
+	rows := make([][]string, 0, len(report))
+	for _, track := range report {
+		rows = append(rows, []string{
+			track.TrackName,
+			track.Artists,
+			track.Album,
+			track.ReleaseYear,
+			strings.Join(track.MissingFrom, ", "),
+			strings.Join(track.CoveredBy, ", "),
+		})
+	}
+	return w.writeFiles(ctx, csvFile{name: "combined_report.csv", headers: headers, rows: rows})
+}
+
+// csvFile is a CSV file waiting to be written
+type csvFile struct {
+	name    string
+	headers []string
+	rows    [][]string
+}
+
+// trackFile builds a CSV file of track data
+func trackFile(filename string, tracks []processor.TrackData) csvFile {
+	headers := []string{"Playlist", "Track Name", "Artist(s)", "Album", "Item Type", "Availability", "Release Date", "Release Date Precision", "Release Year", "Year Source", "NotInTopTrackPlaylist", "Found In Top Tracks Playlist", "Match Strategy", "Match Score", "Play Count", "Minutes Played"}
+	rows := make([][]string, 0, len(tracks))
+	for _, track := range tracks {
+		rows = append(rows, []string{
 			track.PlaylistName,
 			track.TrackName,
 			track.Artists,
 			track.Album,
+			track.ItemType,
+			track.Availability,
 			track.ReleaseDate,
+			track.DatePrecision,
 			track.ReleaseYear,
+			track.YearSource,
 			track.NotInTopTracks,
+			track.FoundInTopTracks,
+			track.MatchStrategy,
+			track.MatchScore,
+			track.PlayCount,
+			track.MinutesPlayed,
+		})
+	}
+	return csvFile{name: filename, headers: headers, rows: rows}
+}
+
+// rename moves a file into place; tests replace it to simulate a failed rename
+var rename = os.Rename
+
+// writeFiles writes each file to a temporary file in the output directory and
+// only renames them into place once all of them are complete. On error or
+// cancellation the temporary files are removed and existing files are left untouched.
+// Files already replaced when a later rename fails are restored from their backups.
+func (w *CSVWriter) writeFiles(ctx context.Context, files ...csvFile) error {
+	return w.replaceFiles(ctx, files, nil)
+}
+
+// replaceFiles writes files like writeFiles and then removes the stale files, output
+// of an earlier run that this run has nothing to write to. The stale files are only
+// removed once every file is in place.
+func (w *CSVWriter) replaceFiles(ctx context.Context, files []csvFile, stale []string) error {
+	// Check every file before writing or removing any of them
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(w.outputDir, file.name)); err == nil {
+			if !w.overwrite {
+				return fmt.Errorf("file %s already exists and overwrite is disabled", file.name)
+			}
+			log.Printf("File %s already exists. It will be replaced...", file.name)
+		}
+	}
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(w.outputDir, name)); err == nil && !w.overwrite {
+			return fmt.Errorf("file %s is out of date and overwrite is disabled", name)
+		}
+	}
+
+	temps := make([]string, 0, len(files))
+	defer func() {
+		// Nothing is left behind if the files were not all renamed into place
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}()
+
+	for _, file := range files {
+		temp, err := w.writeTemp(ctx, file)
+		if temp != "" {
+			temps = append(temps, temp)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Each existing file is moved to a backup before it is replaced, so a failed
+	// rename can put back the files replaced before it
+	var replaced []replacement
+	restore := func() {
+		for i := len(replaced) - 1; i >= 0; i-- {
+			r := replaced[i]
+			if r.backup == "" {
+				os.Remove(r.path)
+			} else if err := rename(r.backup, r.path); err != nil {
+				log.Printf("Warning: failed to restore %s from %s: %v", r.path, r.backup, err)
+			}
+		}
+	}
+	for i, file := range files {
+		path := filepath.Join(w.outputDir, file.name)
+		backup, err := backupFile(path)
+		if err != nil {
+			restore()
+			return err
+		}
+		replaced = append(replaced, replacement{path: path, backup: backup})
+		if err := rename(temps[i], path); err != nil {
+			restore()
+			return fmt.Errorf("failed to replace file %s: %v", file.name, err)
+		}
+	}
+	temps = nil
+	for _, r := range replaced {
+		if r.backup != "" {
+			os.Remove(r.backup)
 		}
+	}
 
+	for _, name := range stale {
+		err := os.Remove(filepath.Join(w.outputDir, name))
+		if err == nil {
+			log.Printf("Removed out-of-date file %s", name)
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove out-of-date file %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// replacement is a file renamed into place and the backup of the file it replaced,
+// if there was one
+type replacement struct {
+	path   string
+	backup string
+}
+
+// backupFile moves an existing file to a new backup file next to it and returns the
+// backup's path, or an empty path if there is no file to back up
+func backupFile(path string) (string, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.bak")
+	if err != nil {
+		return "", fmt.Errorf("failed to back up %s: %v", filepath.Base(path), err)
+	}
+	file.Close()
+	if err := rename(path, file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to back up %s: %v", filepath.Base(path), err)
+	}
+	return file.Name(), nil
+}
+
+// writeTemp writes the headers and rows of a file to a temporary file in the
+// output directory and returns its path
+func (w *CSVWriter) writeTemp(ctx context.Context, f csvFile) (string, error) {
+	filename := f.name
+	file, err := os.CreateTemp(w.outputDir, "."+filename+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	// Temporary files are private; the final file is readable like any other output
+	if err := file.Chmod(0644); err != nil {
+		return file.Name(), fmt.Errorf("failed to set permissions of %s: %v", filename, err)
+	}
+
+	// Add UTF-8 BOM for proper Excel encoding
+	if _, err := file.Write([]byte{0xEF, 0xBB, 0xBF}); err != nil {
+		return file.Name(), fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+
+	writer := csv.NewWriter(file)
+
+	// Write headers
+	if err := writer.Write(f.headers); err != nil {
+		return file.Name(), fmt.Errorf("failed to write headers: %v", err)
+	}
+
+	// Write rows with progress logging
+	totalRows := len(f.rows)
+	log.Printf("Writing %d rows to %s...", totalRows, filename)
+
+	for i, row := range f.rows {
 		if err := writer.Write(row); err != nil {
-			return fmt.Errorf("failed to write track %s: %v", track.TrackName, err)
+			return file.Name(), fmt.Errorf("failed to write row %d: %v", i+1, err)
 		}
 
-		// Log progress every 100 tracks
+		// Log progress and check for cancellation every 100 rows
 		if (i+1)%100 == 0 {
-			log.Printf("Progress: %d/%d tracks written to %s", i+1, totalTracks, filename)
+			log.Printf("Progress: %d/%d rows written to %s", i+1, totalRows, filename)
+			if err := ctx.Err(); err != nil {
+				return file.Name(), fmt.Errorf("writing %s cancelled: %v", filename, err)
+			}
 		}
 	}
 
-	log.Printf("Successfully wrote %d tracks to %s", totalTracks, filename)
-	return nil
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return file.Name(), fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		return file.Name(), fmt.Errorf("failed to close %s: %v", filename, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return file.Name(), fmt.Errorf("writing %s cancelled: %v", filename, err)
+	}
+
+	log.Printf("Successfully wrote %d rows to %s", totalRows, filename)
+	return file.Name(), nil
 }
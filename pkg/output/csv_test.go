@@ -0,0 +1,224 @@
+package output
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/processor"
+	"github.com/mikev/spotify-analysis/pkg/suggest"
+)
+
+// tracks returns n rows of track data for a "user" playlist
+func tracks(n int) map[string][]processor.TrackData {
+	data := make([]processor.TrackData, n)
+	for i := range data {
+		data[i] = processor.TrackData{PlaylistName: "Playlist", TrackName: "Song"}
+	}
+	return map[string][]processor.TrackData{"user": data}
+}
+
+func TestWriteTracks(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTracks(context.Background(), tracks(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "user_playlists.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "\ufeffPlaylist,Track Name,") || strings.Count(string(data), "\n") != 4 {
+		t.Errorf("unexpected CSV contents: %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only user_playlists.csv, found %d files", len(entries))
+	}
+}
+
+func TestWriteTracksCancelled(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "user_playlists.csv")
+	if err := os.WriteFile(existing, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := w.WriteTracks(ctx, tracks(250)); err == nil {
+		t.Fatal("expected a cancelled write to fail")
+	}
+
+	// The existing file is kept and the temporary file is removed
+	data, err := os.ReadFile(existing)
+	if err != nil || string(data) != "previous" {
+		t.Errorf("expected the existing file to be kept, got %q (%v)", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected no temporary files, found %d files", len(entries))
+	}
+}
+
+func TestWriteTracksFailedRename(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"user_playlists.csv", "other_playlists.csv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("previous "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second file fails to be renamed into place after the first one was replaced
+	defer func(original func(string, string) error) { rename = original }(rename)
+	rename = func(from, to string) error {
+		if strings.HasSuffix(from, ".tmp") && filepath.Base(to) == "other_playlists.csv" {
+			return os.ErrPermission
+		}
+		return os.Rename(from, to)
+	}
+
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := tracks(3)
+	data["other"] = data["user"]
+	if err := w.WriteTracks(context.Background(), data); err == nil || !strings.Contains(err.Error(), "other_playlists.csv") {
+		t.Fatalf("expected the failed rename to be reported, got %v", err)
+	}
+
+	// Both files are left as they were, without temporary or backup files
+	for _, name := range []string{"user_playlists.csv", "other_playlists.csv"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(content) != "previous "+name {
+			t.Errorf("expected %s to be restored, got %q (%v)", name, content, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected no leftover files, found %d files", len(entries))
+	}
+}
+
+func TestWriteTracksNoOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "user_playlists.csv"), []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewCSVWriter(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteTracks(context.Background(), tracks(1)); err == nil {
+		t.Error("expected an error when overwriting is disabled")
+	}
+}
+
+func TestWriteFailedPlaylistsRemovesStaleFile(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "failed_playlists.csv")
+
+	failed := []processor.FailedPlaylist{{PlaylistID: "p1", PlaylistName: "Broken", Owner: "me", Error: "503"}}
+	if err := w.WriteFailedPlaylists(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected failed_playlists.csv after a failing run: %v", err)
+	}
+
+	// A clean run must not keep reporting the old failures
+	if err := w.WriteFailedPlaylists(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected failed_playlists.csv to be removed after a clean run, got %v", err)
+	}
+	// Nothing to remove is not an error
+	if err := w.WriteFailedPlaylists(context.Background(), nil); err != nil {
+		t.Errorf("unexpected error without a file to remove: %v", err)
+	}
+}
+
+func TestWriteDataQualityRemovesStaleFile(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "data_quality.csv")
+
+	issues := []processor.DataIssue{{PlaylistName: "Road Trip", TrackName: "Lost Tapes", Field: "Release Date", Value: "0000", Problem: "implausible year"}}
+	if err := w.WriteDataQuality(context.Background(), issues); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected data_quality.csv with issues: %v", err)
+	}
+
+	// Once the dates are fixed, the old issues are no longer reported
+	if err := w.WriteDataQuality(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected data_quality.csv to be removed without issues, got %v", err)
+	}
+
+	// With overwriting disabled the stale file is kept and reported
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewCSVWriter(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteDataQuality(context.Background(), nil); err == nil {
+		t.Error("expected an error when the stale file can't be removed")
+	}
+}
+
+func TestWriteSuggestionsRemovesStaleYears(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewCSVWriter(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranking := func(years ...string) map[string][]suggest.Suggestion {
+		suggestions := make(map[string][]suggest.Suggestion)
+		for _, year := range years {
+			suggestions[year] = []suggest.Suggestion{{Rank: 1, Candidate: suggest.Candidate{TrackName: "Song", ReleaseYear: year}}}
+		}
+		return suggestions
+	}
+
+	files, err := w.WriteSuggestions(context.Background(), ranking("2021", "2022"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "suggestions_2021.csv,suggestions_2022.csv" {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	// 2021 has no candidates left, so its old ranking goes
+	if _, err := w.WriteSuggestions(context.Background(), ranking("2022"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "suggestions_2021.csv")); !os.IsNotExist(err) {
+		t.Errorf("expected suggestions_2021.csv to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "suggestions_2022.csv")); err != nil {
+		t.Errorf("expected suggestions_2022.csv to be kept: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package processor
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+)
+
+// AccountTracks holds the processed tracks of one named account
+type AccountTracks struct {
+	Account string
+	Tracks  map[string][]TrackData
+}
+
+// CombinedTrack describes an eligible track that is missing from the top tracks
+// playlists of at least one account
+type CombinedTrack struct {
+	TrackName   string
+	Artists     string
+	Album       string
+	ReleaseYear string
+	MissingFrom []string
+	CoveredBy   []string
+}
+
+// CombineAccounts builds a report of eligible tracks and whose top tracks playlists they are
+// missing from. A track counts for an account if it appears in one of that account's playlists.
+func CombineAccounts(cfg *config.Config, accounts []AccountTracks) []CombinedTrack {
+	combined := make(map[string]*CombinedTrack)
+	var order []string
+
+	for _, acct := range accounts {
+		missing := make(map[string]bool)
+		covered := make(map[string]bool)
+
+		for _, group := range []string{"user", "other"} {
+			for _, track := range acct.Tracks[group] {
+				if !inYearRange(cfg, track.ReleaseYear) {
+					continue
+				}
+
+				key := combinedKey(track)
+				entry, exists := combined[key]
+				if !exists {
+					entry = &CombinedTrack{
+						TrackName:   track.TrackName,
+						Artists:     track.Artists,
+						Album:       track.Album,
+						ReleaseYear: track.ReleaseYear,
+					}
+					combined[key] = entry
+					order = append(order, key)
+				}
+
+				if track.Flagged() {
+					if !missing[key] {
+						missing[key] = true
+						entry.MissingFrom = append(entry.MissingFrom, acct.Account)
+					}
+				} else if !covered[key] {
+					covered[key] = true
+					entry.CoveredBy = append(entry.CoveredBy, acct.Account)
+				}
+			}
+		}
+	}
+
+	var report []CombinedTrack
+	for _, key := range order {
+		if entry := combined[key]; len(entry.MissingFrom) > 0 {
+			report = append(report, *entry)
+		}
+	}
+
+	// Tracks missing from the most accounts first, then by year and name
+	sort.SliceStable(report, func(i, j int) bool {
+		if len(report[i].MissingFrom) != len(report[j].MissingFrom) {
+			return len(report[i].MissingFrom) > len(report[j].MissingFrom)
+		}
+		if report[i].ReleaseYear != report[j].ReleaseYear {
+			return report[i].ReleaseYear < report[j].ReleaseYear
+		}
+		return report[i].TrackName < report[j].TrackName
+	})
+
+	return report
+}
+
+// combinedKey identifies a track across accounts
+func combinedKey(track TrackData) string {
+	if track.TrackID != "" {
+		return track.TrackID
+	}
+	return strings.ToLower(track.TrackName + "\x00" + track.Artists)
+}
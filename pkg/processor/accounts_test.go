@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCombineAccounts(t *testing.T) {
+	track := func(id, name, year string, missing bool) TrackData {
+		data := TrackData{TrackID: id, TrackName: name, Artists: "Alpha", ReleaseYear: year}
+		if missing {
+			data.NotInTopTracks = FlagMissing
+		}
+		return data
+	}
+	accounts := []AccountTracks{
+		{Account: "alice", Tracks: map[string][]TrackData{
+			"user": {
+				track("t1", "Shared Song", "2021", true),
+				track("t2", "Both Miss", "2022", true),
+				track("t3", "Alice Has It", "2021", false),
+				track("t4", "Too Old", "2010", true),
+			},
+			// The same track in another playlist counts once
+			"other": {track("t1", "Shared Song", "2021", true)},
+		}},
+		{Account: "bob", Tracks: map[string][]TrackData{
+			"user": {
+				track("t1", "Shared Song", "2021", false),
+				track("t2", "Both Miss", "2022", true),
+				track("t3", "Alice Has It", "2021", false),
+			},
+		}},
+	}
+
+	var got []string
+	for _, entry := range CombineAccounts(testConfig(1), accounts) {
+		got = append(got, fmt.Sprintf("%s missing from %s covered by %s", entry.TrackName,
+			strings.Join(entry.MissingFrom, "+"), strings.Join(entry.CoveredBy, "+")))
+	}
+	want := []string{
+		"Both Miss missing from alice+bob covered by ",
+		"Shared Song missing from alice covered by bob",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected combined report:\n%s", strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,18 @@
+package processor
+
+import "github.com/zmb3/spotify"
+
+// SpotifyAPI is the subset of the Spotify Web API used by the playlist processor.
+// *spotify.Client satisfies it; FakeSpotify is an in-memory implementation for offline use.
+type SpotifyAPI interface {
+	CurrentUser() (*spotify.PrivateUser, error)
+	CurrentUsersPlaylistsOpt(opt *spotify.Options) (*spotify.SimplePlaylistPage, error)
+	GetPlaylistTracksOpt(playlistID spotify.ID, opt *spotify.Options, fields string) (*spotify.PlaylistTrackPage, error)
+	SearchOpt(query string, t spotify.SearchType, opt *spotify.Options) (*spotify.SearchResult, error)
+	CurrentUsersTracksOpt(opt *spotify.Options) (*spotify.SavedTrackPage, error)
+	CurrentUsersAlbumsOpt(opt *spotify.Options) (*spotify.SavedAlbumPage, error)
+	GetAlbumTracksOpt(id spotify.ID, opt *spotify.Options) (*spotify.SimpleTrackPage, error)
+	CurrentUsersTopTracksOpt(opt *spotify.Options) (*spotify.FullTrackPage, error)
+	PlayerRecentlyPlayedOpt(opt *spotify.RecentlyPlayedOptions) ([]spotify.RecentlyPlayedItem, error)
+	GetTracksOpt(opt *spotify.Options, ids ...spotify.ID) ([]*spotify.FullTrack, error)
+}
@@ -0,0 +1,326 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/zmb3/spotify"
+)
+
+// FakeSpotify is an in-memory SpotifyAPI serving fixture playlists, with the
+// same limit/offset pagination as the Web API
+type FakeSpotify struct {
+	mu        sync.Mutex
+	user      spotify.PrivateUser
+	playlists []spotify.SimplePlaylist
+	tracks    map[spotify.ID][]spotify.PlaylistTrack
+	errors    map[spotify.ID]error
+	// catalog holds tracks that can be searched for without being in a playlist
+	catalog []spotify.FullTrack
+	// savedTracks and savedAlbums hold the user's library
+	savedTracks []spotify.SavedTrack
+	savedAlbums []spotify.SavedAlbum
+	albumTracks map[spotify.ID][]spotify.SimpleTrack
+	// topTracks holds Spotify's top tracks by time range, and recent the recently played tracks
+	topTracks map[string][]spotify.FullTrack
+	recent    []spotify.FullTrack
+}
+
+// NewFakeSpotify creates a fake API for the given current user
+func NewFakeSpotify(userID string) *FakeSpotify {
+	return &FakeSpotify{
+		user:        spotify.PrivateUser{User: spotify.User{ID: userID, DisplayName: userID}},
+		tracks:      make(map[spotify.ID][]spotify.PlaylistTrack),
+		errors:      make(map[spotify.ID]error),
+		albumTracks: make(map[spotify.ID][]spotify.SimpleTrack),
+		topTracks:   make(map[string][]spotify.FullTrack),
+	}
+}
+
+// AddPlaylist adds a playlist owned by ownerID with the given tracks and returns it
+func (f *FakeSpotify) AddPlaylist(id, name, ownerID string, tracks ...spotify.FullTrack) spotify.SimplePlaylist {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	playlist := spotify.SimplePlaylist{
+		ID:         spotify.ID(id),
+		Name:       name,
+		Owner:      spotify.User{ID: ownerID},
+		SnapshotID: fmt.Sprintf("%s-snapshot", id),
+		Tracks:     spotify.PlaylistTracks{Total: uint(len(tracks))},
+	}
+	f.playlists = append(f.playlists, playlist)
+
+	items := make([]spotify.PlaylistTrack, 0, len(tracks))
+	for _, track := range tracks {
+		items = append(items, spotify.PlaylistTrack{Track: track})
+	}
+	f.tracks[playlist.ID] = items
+
+	return playlist
+}
+
+// FailPlaylist makes every track request for the playlist return err
+func (f *FakeSpotify) FailPlaylist(id string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[spotify.ID(id)] = err
+}
+
+// AddCatalogTrack adds a track that is only found by searching, such as another release of a playlist track
+func (f *FakeSpotify) AddCatalogTrack(track spotify.FullTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.catalog = append(f.catalog, track)
+}
+
+// AddSavedTrack adds tracks to the user's Liked Songs
+func (f *FakeSpotify) AddSavedTrack(tracks ...spotify.FullTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, track := range tracks {
+		f.savedTracks = append(f.savedTracks, spotify.SavedTrack{FullTrack: track})
+	}
+}
+
+// AddSavedAlbum adds an album with the given tracks to the user's saved albums.
+// Like the Web API, the saved album only includes the first page of its tracks.
+func (f *FakeSpotify) AddSavedAlbum(album spotify.SimpleAlbum, tracks ...spotify.SimpleTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	first := tracks
+	if len(first) > 50 {
+		first = first[:50]
+	}
+	saved := spotify.SavedAlbum{FullAlbum: spotify.FullAlbum{SimpleAlbum: album}}
+	saved.Tracks.Tracks = first
+	saved.Tracks.Total = len(tracks)
+	f.savedAlbums = append(f.savedAlbums, saved)
+	f.albumTracks[album.ID] = tracks
+}
+
+// SetTopTracks sets Spotify's top tracks of a time range ("short", "medium" or "long")
+func (f *FakeSpotify) SetTopTracks(timeRange string, tracks ...spotify.FullTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.topTracks[timeRange] = tracks
+}
+
+// AddRecentlyPlayed adds plays to the recently played tracks, most recent first
+func (f *FakeSpotify) AddRecentlyPlayed(tracks ...spotify.FullTrack) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recent = append(f.recent, tracks...)
+}
+
+// CurrentUser returns the fake user
+func (f *FakeSpotify) CurrentUser() (*spotify.PrivateUser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user := f.user
+	return &user, nil
+}
+
+// CurrentUsersPlaylistsOpt returns a page of the fixture playlists
+func (f *FakeSpotify) CurrentUsersPlaylistsOpt(opt *spotify.Options) (*spotify.SimplePlaylistPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	start, end := pageBounds(opt, len(f.playlists), 20)
+	page := &spotify.SimplePlaylistPage{Playlists: append([]spotify.SimplePlaylist(nil), f.playlists[start:end]...)}
+	page.Total = len(f.playlists)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// GetPlaylistTracksOpt returns a page of a fixture playlist's tracks
+func (f *FakeSpotify) GetPlaylistTracksOpt(playlistID spotify.ID, opt *spotify.Options, fields string) (*spotify.PlaylistTrackPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errors[playlistID]; err != nil {
+		return nil, err
+	}
+	items, exists := f.tracks[playlistID]
+	if !exists {
+		return nil, spotify.Error{Message: "Not found.", Status: 404}
+	}
+
+	start, end := pageBounds(opt, len(items), 100)
+	page := &spotify.PlaylistTrackPage{Tracks: append([]spotify.PlaylistTrack(nil), items[start:end]...)}
+	page.Total = len(items)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// SearchOpt finds tracks by ISRC, the only kind of search the processor makes.
+// Playlist tracks and catalog tracks are searched.
+func (f *FakeSpotify) SearchOpt(query string, t spotify.SearchType, opt *spotify.Options) (*spotify.SearchResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	isrc, ok := strings.CutPrefix(query, "isrc:")
+	if !ok || t != spotify.SearchTypeTrack {
+		return nil, spotify.Error{Message: "Unsupported search.", Status: 400}
+	}
+
+	var found []spotify.FullTrack
+	seen := make(map[spotify.ID]bool)
+	add := func(track spotify.FullTrack) {
+		if strings.EqualFold(track.ExternalIDs["isrc"], isrc) && !seen[track.ID] {
+			seen[track.ID] = true
+			found = append(found, track)
+		}
+	}
+	for _, playlist := range f.playlists {
+		for _, item := range f.tracks[playlist.ID] {
+			add(item.Track)
+		}
+	}
+	for _, track := range f.catalog {
+		add(track)
+	}
+
+	start, end := pageBounds(opt, len(found), 20)
+	page := &spotify.FullTrackPage{Tracks: found[start:end]}
+	page.Total = len(found)
+	page.Offset = start
+	page.Limit = end - start
+	return &spotify.SearchResult{Tracks: page}, nil
+}
+
+// CurrentUsersTracksOpt returns a page of the user's Liked Songs
+func (f *FakeSpotify) CurrentUsersTracksOpt(opt *spotify.Options) (*spotify.SavedTrackPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	start, end := pageBounds(opt, len(f.savedTracks), 20)
+	page := &spotify.SavedTrackPage{Tracks: append([]spotify.SavedTrack(nil), f.savedTracks[start:end]...)}
+	page.Total = len(f.savedTracks)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// CurrentUsersAlbumsOpt returns a page of the user's saved albums
+func (f *FakeSpotify) CurrentUsersAlbumsOpt(opt *spotify.Options) (*spotify.SavedAlbumPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	start, end := pageBounds(opt, len(f.savedAlbums), 20)
+	page := &spotify.SavedAlbumPage{Albums: append([]spotify.SavedAlbum(nil), f.savedAlbums[start:end]...)}
+	page.Total = len(f.savedAlbums)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// GetAlbumTracksOpt returns a page of a saved album's tracks
+func (f *FakeSpotify) GetAlbumTracksOpt(id spotify.ID, opt *spotify.Options) (*spotify.SimpleTrackPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tracks, exists := f.albumTracks[id]
+	if !exists {
+		return nil, spotify.Error{Message: "Not found.", Status: 404}
+	}
+	start, end := pageBounds(opt, len(tracks), 20)
+	page := &spotify.SimpleTrackPage{Tracks: append([]spotify.SimpleTrack(nil), tracks[start:end]...)}
+	page.Total = len(tracks)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// CurrentUsersTopTracksOpt returns a page of Spotify's top tracks for the time range
+func (f *FakeSpotify) CurrentUsersTopTracksOpt(opt *spotify.Options) (*spotify.FullTrackPage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	timeRange := "medium"
+	if opt != nil && opt.Timerange != nil {
+		timeRange = *opt.Timerange
+	}
+	tracks := f.topTracks[timeRange]
+	start, end := pageBounds(opt, len(tracks), 20)
+	page := &spotify.FullTrackPage{Tracks: append([]spotify.FullTrack(nil), tracks[start:end]...)}
+	page.Total = len(tracks)
+	page.Offset = start
+	page.Limit = end - start
+	return page, nil
+}
+
+// PlayerRecentlyPlayedOpt returns the recently played tracks, without their albums like the Web API
+func (f *FakeSpotify) PlayerRecentlyPlayedOpt(opt *spotify.RecentlyPlayedOptions) ([]spotify.RecentlyPlayedItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	limit := 20
+	if opt != nil && opt.Limit > 0 {
+		limit = opt.Limit
+	}
+	var items []spotify.RecentlyPlayedItem
+	for _, track := range f.recent {
+		if len(items) == limit {
+			break
+		}
+		items = append(items, spotify.RecentlyPlayedItem{Track: track.SimpleTrack})
+	}
+	return items, nil
+}
+
+// GetTracksOpt returns the tracks with the given IDs, or nil for unknown IDs
+func (f *FakeSpotify) GetTracksOpt(opt *spotify.Options, ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	known := make(map[spotify.ID]spotify.FullTrack)
+	for _, items := range f.tracks {
+		for _, item := range items {
+			known[item.Track.ID] = item.Track
+		}
+	}
+	for _, album := range f.savedAlbums {
+		for _, track := range f.albumTracks[album.ID] {
+			known[track.ID] = spotify.FullTrack{SimpleTrack: track, Album: album.SimpleAlbum}
+		}
+	}
+	for _, tracks := range [][]spotify.FullTrack{f.catalog, f.recent} {
+		for _, track := range tracks {
+			known[track.ID] = track
+		}
+	}
+
+	found := make([]*spotify.FullTrack, 0, len(ids))
+	for _, id := range ids {
+		if track, exists := known[id]; exists {
+			found = append(found, &track)
+		} else {
+			found = append(found, nil)
+		}
+	}
+	return found, nil
+}
+
+// pageBounds returns the slice bounds selected by the limit/offset options
+func pageBounds(opt *spotify.Options, total, defaultLimit int) (int, int) {
+	offset, limit := 0, defaultLimit
+	if opt != nil && opt.Offset != nil {
+		offset = *opt.Offset
+	}
+	if opt != nil && opt.Limit != nil {
+		limit = *opt.Limit
+	}
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
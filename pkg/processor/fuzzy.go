@@ -0,0 +1,42 @@
+package processor
+
+import (
+	"github.com/mikev/spotify-analysis/pkg/match"
+)
+
+// PossibleMatch is a marked track that closely resembles a track of the top tracks
+// playlist of its release year, for example a re-recording or a regional release
+type PossibleMatch struct {
+	// Playlists names the playlists the track is in
+	Playlists []string
+	Track     match.Track
+	Candidate match.Candidate
+}
+
+// nearMatch finds the closest track of a year's top tracks playlists when fuzzy
+// matching is enabled, skipping candidates that were rejected in a review
+func (p *PlaylistProcessor) nearMatch(year string, track match.Track) (match.Candidate, bool) {
+	if !p.cfg.FuzzyMatch {
+		return match.Candidate{}, false
+	}
+	rejected := func(candidate match.Track) bool {
+		return p.decisions.Get(track, candidate) == match.DecisionReject
+	}
+	return p.topTracksByYear[year].Closest(track, p.cfg.FuzzyThreshold, p.cfg.FuzzyDurationTolerance, rejected)
+}
+
+// addPossibleMatch records a near match for review, once per track and candidate
+func (p *PlaylistProcessor) addPossibleMatch(playlist string, track match.Track, candidate match.Candidate) {
+	trackID, candidateID := match.Identity(track), match.Identity(candidate.Track)
+	for _, existing := range p.possibleMatches {
+		if match.Identity(existing.Track) == trackID && match.Identity(existing.Candidate.Track) == candidateID {
+			existing.Playlists = match.AppendUnique(existing.Playlists, playlist)
+			return
+		}
+	}
+	p.possibleMatches = append(p.possibleMatches, &PossibleMatch{
+		Playlists: []string{playlist},
+		Track:     track,
+		Candidate: candidate,
+	})
+}
@@ -0,0 +1,95 @@
+package processor
+
+import "github.com/zmb3/spotify"
+
+// Types of playlist items
+const (
+	ItemTrack   = "track"
+	ItemEpisode = "episode"
+	ItemLocal   = "local"
+)
+
+// Availability of playlist items
+const (
+	AvailabilityAvailable = "available"
+	// AvailabilityUnavailable marks an item Spotify no longer returns, such as a track
+	// removed from the catalog
+	AvailabilityUnavailable = "unavailable"
+	// AvailabilityRegionRestricted marks a track that can't be played in the market
+	// the playlists are fetched for
+	AvailabilityRegionRestricted = "region_restricted"
+)
+
+// PlaylistSummary counts the kinds of items in a processed playlist
+type PlaylistSummary struct {
+	PlaylistID       string
+	PlaylistName     string
+	Owner            string
+	Items            int
+	Tracks           int
+	Episodes         int
+	LocalFiles       int
+	Unavailable      int
+	RegionRestricted int
+}
+
+// classifyItem returns the type and availability of a playlist item
+func classifyItem(item spotify.PlaylistTrack) (string, string) {
+	// Local files are played from the user's device, so Spotify's availability doesn't apply
+	if item.IsLocal {
+		return ItemLocal, AvailabilityAvailable
+	}
+
+	itemType := ItemTrack
+	if item.Track.Type == ItemEpisode {
+		itemType = ItemEpisode
+	}
+	// Spotify returns a null track for items it can no longer find
+	if item.Track.ID == "" {
+		return itemType, AvailabilityUnavailable
+	}
+	// Playability is only reported when the playlists are fetched for a market
+	if item.Track.IsPlayable != nil && !*item.Track.IsPlayable {
+		return itemType, AvailabilityRegionRestricted
+	}
+	return itemType, AvailabilityAvailable
+}
+
+// isMusic reports whether a playlist item takes part in top tracks matching. Podcast
+// episodes only do if SPOTIFY_MATCH_NON_MUSIC is set, and items Spotify can no longer
+// find never do, since there is nothing left to match them by.
+func (p *PlaylistProcessor) isMusic(item spotify.PlaylistTrack) bool {
+	itemType, availability := classifyItem(item)
+	if availability == AvailabilityUnavailable {
+		return false
+	}
+	return itemType != ItemEpisode || p.cfg.MatchNonMusic
+}
+
+// summarize counts the kinds of items in a playlist
+func summarize(playlist spotify.SimplePlaylist, items []spotify.PlaylistTrack) PlaylistSummary {
+	summary := PlaylistSummary{
+		PlaylistID:   string(playlist.ID),
+		PlaylistName: playlist.Name,
+		Owner:        playlist.Owner.ID,
+		Items:        len(items),
+	}
+	for _, item := range items {
+		itemType, availability := classifyItem(item)
+		switch itemType {
+		case ItemTrack:
+			summary.Tracks++
+		case ItemEpisode:
+			summary.Episodes++
+		case ItemLocal:
+			summary.LocalFiles++
+		}
+		switch availability {
+		case AvailabilityUnavailable:
+			summary.Unavailable++
+		case AvailabilityRegionRestricted:
+			summary.RegionRestricted++
+		}
+	}
+	return summary
+}
@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+func TestClassifyItem(t *testing.T) {
+	playable, unplayable := true, false
+	track := func(id, kind string, isPlayable *bool) spotify.PlaylistTrack {
+		item := spotify.PlaylistTrack{}
+		item.Track.ID = spotify.ID(id)
+		item.Track.Type = kind
+		item.Track.IsPlayable = isPlayable
+		return item
+	}
+	local := track("", "track", nil)
+	local.IsLocal = true
+
+	tests := []struct {
+		name         string
+		item         spotify.PlaylistTrack
+		itemType     string
+		availability string
+		music        bool
+	}{
+		{"track", track("t1", "track", nil), ItemTrack, AvailabilityAvailable, true},
+		{"playable track", track("t2", "track", &playable), ItemTrack, AvailabilityAvailable, true},
+		{"restricted track", track("t3", "track", &unplayable), ItemTrack, AvailabilityRegionRestricted, true},
+		{"null track", track("", "", nil), ItemTrack, AvailabilityUnavailable, false},
+		{"episode", track("e1", "episode", nil), ItemEpisode, AvailabilityAvailable, false},
+		{"local file", local, ItemLocal, AvailabilityAvailable, true},
+	}
+	p := &PlaylistProcessor{cfg: testConfig(1)}
+	for _, test := range tests {
+		itemType, availability := classifyItem(test.item)
+		if itemType != test.itemType || availability != test.availability {
+			t.Errorf("%s: expected %s/%s, got %s/%s", test.name, test.itemType, test.availability, itemType, availability)
+		}
+		if music := p.isMusic(test.item); music != test.music {
+			t.Errorf("%s: expected isMusic %t, got %t", test.name, test.music, music)
+		}
+	}
+
+	// Episodes can be matched on request
+	p.cfg.MatchNonMusic = true
+	if !p.isMusic(track("e1", "episode", nil)) {
+		t.Error("expected episodes to be matched with MatchNonMusic")
+	}
+}
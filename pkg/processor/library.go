@@ -0,0 +1,199 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/zmb3/spotify"
+)
+
+// Liked Songs is processed as a pseudo-playlist with this ID and name
+const (
+	LikedSongsID   = "liked-songs"
+	LikedSongsName = "Liked Songs"
+)
+
+// Saved albums are processed as pseudo-playlists whose ID is the album ID with this
+// prefix and whose name is the album name with albumNamePrefix
+const (
+	albumIDPrefix   = "album:"
+	albumNamePrefix = "Album: "
+)
+
+// isLibrary reports whether a playlist is a pseudo-playlist of the user's library
+func isLibrary(playlist spotify.SimplePlaylist) bool {
+	return playlist.ID == LikedSongsID || strings.HasPrefix(string(playlist.ID), albumIDPrefix)
+}
+
+// fetchLibrary fetches the enabled library sources, Liked Songs and the tracks of
+// saved albums, as pseudo-playlists owned by the user. The library has no snapshot
+// ID, so it is fetched on every run instead of being cached.
+func (p *PlaylistProcessor) fetchLibrary(ctx context.Context) ([]spotify.SimplePlaylist, []playlistFetch, error) {
+	var playlists []spotify.SimplePlaylist
+	var fetched []playlistFetch
+	add := func(id, name string, items []spotify.PlaylistTrack) {
+		playlists = append(playlists, spotify.SimplePlaylist{
+			ID:     spotify.ID(id),
+			Name:   name,
+			Owner:  spotify.User{ID: p.userID},
+			Tracks: spotify.PlaylistTracks{Total: uint(len(items))},
+		})
+		fetched = append(fetched, playlistFetch{items: items})
+	}
+
+	if p.cfg.IncludeLikedSongs {
+		log.Println("Fetching liked songs...")
+		items, err := p.fetchLikedSongs(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Found %d liked songs", len(items))
+		add(LikedSongsID, LikedSongsName, items)
+	}
+
+	if p.cfg.IncludeSavedAlbums {
+		log.Println("Fetching saved albums...")
+		albums, err := p.fetchSavedAlbums(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Found %d saved albums", len(albums))
+		for _, album := range albums {
+			items, err := p.albumItems(ctx, album)
+			if err != nil {
+				return nil, nil, err
+			}
+			add(albumIDPrefix+string(album.ID), albumNamePrefix+album.Name, items)
+		}
+	}
+	return playlists, fetched, nil
+}
+
+// fetchLikedSongs retrieves the user's saved tracks with pagination
+func (p *PlaylistProcessor) fetchLikedSongs(ctx context.Context) ([]spotify.PlaylistTrack, error) {
+	var items []spotify.PlaylistTrack
+	offset := 0
+	limit := 50 // Maximum allowed by Spotify API
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("playlist processing cancelled: %v", err)
+		}
+
+		page, err := p.client.CurrentUsersTracksOpt(p.libraryOptions(limit, offset))
+		if err != nil {
+			return nil, permissionError("liked songs", err)
+		}
+		for _, saved := range page.Tracks {
+			items = append(items, spotify.PlaylistTrack{AddedAt: saved.AddedAt, Track: saved.FullTrack})
+		}
+
+		if len(page.Tracks) < limit {
+			break
+		}
+		offset += limit
+	}
+	return items, nil
+}
+
+// fetchSavedAlbums retrieves the user's saved albums with pagination
+func (p *PlaylistProcessor) fetchSavedAlbums(ctx context.Context) ([]spotify.SavedAlbum, error) {
+	var albums []spotify.SavedAlbum
+	offset := 0
+	limit := 50 // Maximum allowed by Spotify API
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("playlist processing cancelled: %v", err)
+		}
+
+		page, err := p.client.CurrentUsersAlbumsOpt(p.libraryOptions(limit, offset))
+		if err != nil {
+			return nil, permissionError("saved albums", err)
+		}
+		albums = append(albums, page.Albums...)
+
+		if len(page.Albums) < limit {
+			break
+		}
+		offset += limit
+	}
+	return albums, nil
+}
+
+// albumItems returns the tracks of a saved album as playlist items. Saved albums
+// come with their first page of tracks, so only longer albums need more requests.
+// Album tracks lack the album itself, which is filled in from the saved album, and
+// their ISRC, so the full tracks are fetched too.
+func (p *PlaylistProcessor) albumItems(ctx context.Context, album spotify.SavedAlbum) ([]spotify.PlaylistTrack, error) {
+	tracks := album.Tracks.Tracks
+	limit := 50 // Maximum allowed by Spotify API
+	for len(tracks) < album.Tracks.Total {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("playlist processing cancelled: %v", err)
+		}
+
+		page, err := p.client.GetAlbumTracksOpt(album.ID, p.libraryOptions(limit, len(tracks)))
+		if err != nil {
+			return nil, permissionError("tracks of album "+album.Name, err)
+		}
+		if len(page.Tracks) == 0 {
+			break
+		}
+		tracks = append(tracks, page.Tracks...)
+	}
+
+	ids := make([]spotify.ID, 0, len(tracks))
+	for _, track := range tracks {
+		if track.ID != "" {
+			ids = append(ids, track.ID)
+		}
+	}
+	full := make(map[spotify.ID]*spotify.FullTrack)
+	if err := p.fetchFullTracks(ctx, ids, full); err != nil {
+		return nil, fmt.Errorf("failed to get tracks of album %s: %v", album.Name, err)
+	}
+
+	items := make([]spotify.PlaylistTrack, 0, len(tracks))
+	withoutISRC := 0
+	for _, track := range tracks {
+		item := spotify.FullTrack{SimpleTrack: track, Album: album.SimpleAlbum}
+		if found := full[track.ID]; found != nil {
+			item = *found
+			item.Album = album.SimpleAlbum
+		}
+		if match.FromSpotify(item).ISRC == "" {
+			withoutISRC++
+		}
+		items = append(items, spotify.PlaylistTrack{AddedAt: album.AddedAt, Track: item})
+	}
+	if withoutISRC > 0 {
+		log.Printf("Warning: %d tracks of album %s have no ISRC and are matched by their other keys only", withoutISRC, album.Name)
+	}
+	return items, nil
+}
+
+// libraryOptions returns the paging options of a library request, for the configured market
+func (p *PlaylistProcessor) libraryOptions(limit, offset int) *spotify.Options {
+	opt := &spotify.Options{Limit: &limit, Offset: &offset}
+	if p.cfg.Market != "" {
+		opt.Country = &p.cfg.Market
+	}
+	return opt
+}
+
+// permissionError describes a failed request for the user's data. Spotify reports a
+// token without the permission to read it as 403 Forbidden. A saved login missing a
+// required permission is replaced before the run, so this means it was revoked since.
+func permissionError(what string, err error) error {
+	var apiErr spotify.Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusForbidden {
+		return fmt.Errorf("failed to get %s: %v (delete the saved token and log in again to grant the permission)", what, err)
+	}
+	return fmt.Errorf("failed to get %s: %v", what, err)
+}
@@ -0,0 +1,183 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/zmb3/spotify"
+)
+
+// ListeningSource names the listening data in the match review file
+const ListeningSource = "Listening report"
+
+// termRanges are the time ranges of Spotify's top tracks, from the last four weeks
+// to several years, as passed to the API
+var termRanges = []string{"short", "medium", "long"}
+
+// Weights of the listening report score
+const (
+	// rankPoints is what the first track of a time range scores; each lower rank scores one less
+	rankPoints = 50
+	// recentPlayPoints is what each play among the recently played tracks scores
+	recentPlayPoints = 5
+)
+
+// ListeningTrack is a track from Spotify's own top tracks or recently played history
+// that is missing from the top tracks playlist of its release year
+type ListeningTrack struct {
+	TrackID     string
+	TrackName   string
+	Artists     string
+	Album       string
+	ReleaseYear string
+	// ShortTermRank, MediumTermRank and LongTermRank are the track's rank in Spotify's
+	// top tracks of the last four weeks, six months and several years, or 0 if absent
+	ShortTermRank  int
+	MediumTermRank int
+	LongTermRank   int
+	// RecentPlays counts the track's plays among the recently played tracks
+	RecentPlays int
+	// Score ranks the tracks by how heavily they were played
+	Score            int
+	NotInTopTracks   string
+	FoundInTopTracks string
+	MatchStrategy    string
+	MatchScore       string
+}
+
+// listeningReport fetches Spotify's top tracks for each time range and the recently
+// played tracks, and returns those missing from the top tracks playlist of their
+// release year, most played first
+func (p *PlaylistProcessor) listeningReport(ctx context.Context) ([]ListeningTrack, error) {
+	tracks := make(map[spotify.ID]*spotify.FullTrack)
+	entries := make(map[spotify.ID]*ListeningTrack)
+	var order []spotify.ID
+	entry := func(track *spotify.FullTrack) *ListeningTrack {
+		if _, exists := entries[track.ID]; !exists {
+			tracks[track.ID] = track
+			entries[track.ID] = &ListeningTrack{}
+			order = append(order, track.ID)
+		}
+		return entries[track.ID]
+	}
+
+	limit := 50 // Maximum allowed by Spotify API
+	for _, term := range termRanges {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("listening report cancelled: %v", err)
+		}
+		timeRange := term
+		page, err := p.client.CurrentUsersTopTracksOpt(&spotify.Options{Limit: &limit, Timerange: &timeRange})
+		if err != nil {
+			return nil, permissionError(term+" term top tracks", err)
+		}
+		for i := range page.Tracks {
+			track := &page.Tracks[i]
+			if track.ID == "" {
+				continue
+			}
+			rank := i + 1
+			switch term {
+			case "short":
+				entry(track).ShortTermRank = rank
+			case "medium":
+				entry(track).MediumTermRank = rank
+			case "long":
+				entry(track).LongTermRank = rank
+			}
+		}
+	}
+
+	// Spotify only keeps the last 50 plays
+	recent, err := p.client.PlayerRecentlyPlayedOpt(&spotify.RecentlyPlayedOptions{Limit: limit})
+	if err != nil {
+		return nil, permissionError("recently played tracks", err)
+	}
+	var missing []spotify.ID
+	for _, item := range recent {
+		if item.Track.ID == "" {
+			continue
+		}
+		if _, exists := tracks[item.Track.ID]; !exists {
+			missing = append(missing, item.Track.ID)
+			tracks[item.Track.ID] = nil
+		}
+	}
+	// Recently played tracks come without their album, which holds the release date
+	if err := p.fetchFullTracks(ctx, missing, tracks); err != nil {
+		return nil, fmt.Errorf("failed to get recently played tracks: %v", err)
+	}
+	for _, item := range recent {
+		if track := tracks[item.Track.ID]; track != nil {
+			entry(track).RecentPlays++
+		}
+	}
+	log.Printf("Found %d tracks in your Spotify top tracks and recently played history", len(order))
+
+	var report []ListeningTrack
+	for _, id := range order {
+		track, listened := tracks[id], entries[id]
+		year, _ := p.releaseYear(*track)
+		matched := p.matchTopTracks(ListeningSource, *track, year.year)
+		if matched.notInTopTracks == "" {
+			continue
+		}
+
+		listened.TrackID = string(track.ID)
+		listened.TrackName = track.Name
+		listened.Artists = joinArtists(*track)
+		listened.Album = track.Album.Name
+		listened.ReleaseYear = year.year
+		listened.Score = listeningScore(*listened)
+		listened.NotInTopTracks = matched.notInTopTracks
+		listened.FoundInTopTracks = matched.foundInTopTracks
+		listened.MatchStrategy = matched.strategy
+		listened.MatchScore = matched.score
+		report = append(report, *listened)
+	}
+
+	// Ties keep the order the tracks were found in, short term top tracks first
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].Score > report[j].Score
+	})
+	return report, nil
+}
+
+// fetchFullTracks fetches the full track objects of ids in batches of 50 and stores them in tracks
+func (p *PlaylistProcessor) fetchFullTracks(ctx context.Context, ids []spotify.ID, tracks map[spotify.ID]*spotify.FullTrack) error {
+	for start := 0; start < len(ids); start += 50 {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("track lookup cancelled: %v", err)
+		}
+		end := min(start+50, len(ids))
+		var opt *spotify.Options
+		if p.cfg.Market != "" {
+			opt = &spotify.Options{Country: &p.cfg.Market}
+		}
+		found, err := p.client.GetTracksOpt(opt, ids[start:end]...)
+		if err != nil {
+			return fmt.Errorf("failed to get tracks: %v", err)
+		}
+		for _, track := range found {
+			if track != nil {
+				tracks[track.ID] = track
+			}
+		}
+	}
+	return nil
+}
+
+// listeningScore scores how heavily a track was played: rankPoints for the first
+// track of each time range, one less for each lower rank, and recentPlayPoints for
+// each recent play
+func listeningScore(track ListeningTrack) int {
+	score := track.RecentPlays * recentPlayPoints
+	for _, rank := range []int{track.ShortTermRank, track.MediumTermRank, track.LongTermRank} {
+		if rank > 0 {
+			score += max(rankPoints+1-rank, 1)
+		}
+	}
+	return score
+}
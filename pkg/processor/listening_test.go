@@ -0,0 +1,48 @@
+package processor
+
+import (
+	"context"
+	"testing"
+)
+
+func TestListeningReport(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", track("t1", "Kept", "2021-01-01"))
+	api.SetTopTracks("short", track("t1", "Kept", "2021-01-01"), track("t2", "Loved", "2021-06-01"))
+	api.SetTopTracks("medium", track("t3", "Steady", "2022-02-01"))
+	api.SetTopTracks("long", track("t2", "Loved", "2021-06-01"))
+	// Released before the year range, so there is no playlist to miss it from
+	old := track("t5", "Oldie", "2019-01-01")
+	api.AddRecentlyPlayed(track("t4", "Fresh", "2023-03-01"), old, track("t3", "Steady", "2022-02-01"),
+		track("t4", "Fresh", "2023-03-01"), track("t4", "Fresh", "2023-03-01"))
+
+	cfg := testConfig(1)
+	cfg.ListeningReport = true
+	p, err := NewPlaylistProcessor(api, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		id    string
+		score int
+	}{{"t2", 99}, {"t3", 55}, {"t4", 15}}
+	if len(result.Listening) != len(expected) {
+		t.Fatalf("expected %d listening tracks, got %+v", len(expected), result.Listening)
+	}
+	for i, want := range expected {
+		if got := result.Listening[i]; got.TrackID != want.id || got.Score != want.score || got.NotInTopTracks != "TRUE" {
+			t.Errorf("listening track %d: expected %s with score %d, got %+v", i, want.id, want.score, got)
+		}
+	}
+	if loved := result.Listening[0]; loved.ShortTermRank != 2 || loved.MediumTermRank != 0 || loved.LongTermRank != 1 || loved.ReleaseYear != "2021" {
+		t.Errorf("unexpected ranks: %+v", loved)
+	}
+	if fresh := result.Listening[2]; fresh.RecentPlays != 3 || fresh.Album != "Album" {
+		t.Errorf("unexpected recently played track: %+v", fresh)
+	}
+}
@@ -1,126 +1,405 @@
 package processor
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/mikev/spotify-analysis/pkg/cache"
 	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/mikev/spotify-analysis/pkg/releaseyear"
+	"github.com/mikev/spotify-analysis/pkg/streaming"
+	"github.com/mikev/spotify-analysis/pkg/suggest"
 	"github.com/zmb3/spotify"
 )
 
-// TrackInfo holds the unique identifier for a track
-type TrackInfo struct {
-	ID   string
-	Name string
-}
-
 // PlaylistProcessor handles playlist and track processing
 type PlaylistProcessor struct {
-	client       *spotify.Client
-	cfg          *config.Config
-	topTracksMap map[string]TrackInfo
-	userID       string
+	client SpotifyAPI
+	cfg    *config.Config
+	// topTracks finds the top tracks playlists of any year a track is in
+	topTracks *match.Index
+	// topTracksByYear finds the tracks of each year's top tracks playlists
+	topTracksByYear map[string]*match.Index
+	// topArtistsByYear holds the normalized names of the artists in each year's top tracks playlists
+	topArtistsByYear map[string]map[string]bool
+	userID           string
+	cache            *cache.Cache
+	// decisions holds the reviewed possible matches when fuzzy matching is enabled
+	decisions *match.Decisions
+	// possibleMatches collects the near matches awaiting review, in order of discovery
+	possibleMatches []*PossibleMatch
+	// dataIssues collects the problems found in the track data, in playlist order
+	dataIssues []DataIssue
+	// yearOverrides holds the user's release years by track ID or ISRC
+	yearOverrides releaseyear.Overrides
+	// earliestYears holds the earliest release year of each ISRC when that heuristic is enabled
+	earliestYears map[string]string
+	// history holds the imported plays of each track when a streaming history is configured
+	history *streaming.History
 }
 
-// NewPlaylistProcessor creates a new playlist processor
-func NewPlaylistProcessor(client *spotify.Client, cfg *config.Config) (*PlaylistProcessor, error) {
+// NewPlaylistProcessor creates a new playlist processor for any SpotifyAPI implementation
+func NewPlaylistProcessor(client SpotifyAPI, cfg *config.Config) (*PlaylistProcessor, error) {
 	user, err := client.CurrentUser()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get current user: %v", err)
 	}
 
+	// Unchanged playlists are read from the cache instead of the API
+	var playlistCache *cache.Cache
+	if cfg.CacheDir != "" {
+		playlistCache, err = cache.New(cfg.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Reviewed possible matches are honored on every run
+	var decisions *match.Decisions
+	if cfg.FuzzyMatch {
+		decisions, err = match.LoadDecisions(cfg.MatchDecisionsFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d match decisions from %s", decisions.Len(), cfg.MatchDecisionsFile)
+	}
+
+	// Release years set by the user take precedence over Spotify's album dates
+	overrides, err := releaseyear.LoadOverrides(cfg.ReleaseYearOverrides)
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) > 0 {
+		log.Printf("Loaded %d release year overrides from %s", len(overrides), cfg.ReleaseYearOverrides)
+	}
+
+	// Play counts come from the data export the user downloaded from Spotify
+	var history *streaming.History
+	if cfg.StreamingHistoryDir != "" {
+		history, err = streaming.Load(cfg.StreamingHistoryDir)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d streams of %d tracks from %d streaming history files in %s",
+			history.Streams, history.Tracks(), history.Files, cfg.StreamingHistoryDir)
+	}
+
 	return &PlaylistProcessor{
-		client:       client,
-		cfg:          cfg,
-		topTracksMap: make(map[string]TrackInfo),
-		userID:       user.ID,
+		client:        client,
+		cfg:           cfg,
+		userID:        user.ID,
+		cache:         playlistCache,
+		decisions:     decisions,
+		yearOverrides: overrides,
+		history:       history,
 	}, nil
 }
 
-// ProcessPlaylists processes all playlists and returns track data
-func (p *PlaylistProcessor) ProcessPlaylists() (map[string][]TrackData, error) {
-	log.Println("Starting playlist processing...")
+// Result holds the outcome of processing all playlists
+type Result struct {
+	// Tracks holds the track data of the "user" and "other" playlists
+	Tracks map[string][]TrackData
+	// Failed lists the playlists whose tracks could not be fetched
+	Failed []FailedPlaylist
+	// Playlists lists the playlists whose tracks are included, in playlist order
+	Playlists []PlaylistInfo
+	// PossibleMatches lists the near matches to review when fuzzy matching is enabled
+	PossibleMatches []*PossibleMatch
+	// DataIssues lists the malformed values found in the track data
+	DataIssues []DataIssue
+	// Summaries counts the kinds of items in each processed playlist, in playlist order
+	Summaries []PlaylistSummary
+	// Listening lists the heavily played tracks missing from the top tracks playlists,
+	// most played first, when the listening report is enabled
+	Listening []ListeningTrack
+	// Suggestions ranks the tracks missing from each year's top tracks playlist by
+	// release year, when suggestions are enabled
+	Suggestions map[string][]suggest.Suggestion
+}
 
-	// First, collect all tracks from top tracks playlists
-	log.Println("Collecting tracks from top tracks playlists...")
-	if err := p.collectTopTracks(); err != nil {
-		return nil, err
-	}
+// DataIssue describes a malformed value in the data Spotify returned for a track
+type DataIssue struct {
+	PlaylistName string
+	TrackID      string
+	TrackName    string
+	Field        string
+	Value        string
+	Problem      string
+}
+
+// PlaylistInfo identifies a processed playlist
+type PlaylistInfo struct {
+	ID         string
+	Name       string
+	Owner      string
+	SnapshotID string
+}
+
+// FailedPlaylist describes a playlist that could not be processed
+type FailedPlaylist struct {
+	PlaylistID   string
+	PlaylistName string
+	Owner        string
+	Error        string
+}
+
+// ProcessPlaylists fetches all playlists once, fetches their tracks concurrently and
+// returns the track data in playlist order. Cancelling ctx stops the remaining fetches.
+func (p *PlaylistProcessor) ProcessPlaylists(ctx context.Context) (*Result, error) {
+	log.Println("Starting playlist processing...")
 
 	// Get all playlists
 	log.Println("Fetching all playlists...")
-	allPlaylists, err := p.getAllPlaylists()
+	allPlaylists, err := p.getAllPlaylists(ctx)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("Found %d total playlists to process", len(allPlaylists))
 
+	// Fetch the tracks of every playlist we need
+	fetched, err := p.fetchPlaylists(ctx, allPlaylists)
+	if err != nil {
+		return nil, err
+	}
+	if p.cache != nil {
+		stats := p.cache.Stats()
+		log.Printf("Playlist cache: %d hits, %d misses, %d stale, %d errors, %d written",
+			stats.Hits, stats.Misses, stats.Stale, stats.Errors, stats.Writes)
+	}
+
+	// The library is processed after the playlists, as playlists of its own
+	if p.cfg.IncludeLikedSongs || p.cfg.IncludeSavedAlbums {
+		library, libraryItems, err := p.fetchLibrary(ctx)
+		if err != nil {
+			return nil, err
+		}
+		allPlaylists = append(allPlaylists, library...)
+		fetched = append(fetched, libraryItems...)
+	}
+
+	// Collect all tracks from top tracks playlists before marking any track
+	log.Println("Collecting tracks from top tracks playlists...")
+	if err := p.collectTopTracks(allPlaylists, fetched); err != nil {
+		return nil, err
+	}
+
+	// Look up the original release year of songs on compilations and reissues
+	if p.cfg.EarliestISRCYear {
+		if err := p.findEarliestYears(ctx, allPlaylists, fetched); err != nil {
+			return nil, err
+		}
+	}
+
 	// Process playlists and collect track data
+	p.possibleMatches = nil
+	p.dataIssues = nil
 	userTracks := make([]TrackData, 0)
 	otherTracks := make([]TrackData, 0)
+	var failed []FailedPlaylist
+	var processed []PlaylistInfo
+	var summaries []PlaylistSummary
+	candidates := newCandidateSet()
 
 	for i, playlist := range allPlaylists {
-		log.Printf("Processing playlist %d/%d: %s", i+1, len(allPlaylists), playlist.Name)
-		tracks, err := p.processPlaylist(playlist)
-		if err != nil {
+		isOwn := playlist.Owner.ID == p.userID
+		if !isOwn && !p.cfg.IncludeOtherPlaylists {
+			continue
+		}
+
+		if err := fetched[i].err; err != nil {
 			log.Printf("Error processing playlist %s: %v", playlist.Name, err)
+			failed = append(failed, FailedPlaylist{
+				PlaylistID:   string(playlist.ID),
+				PlaylistName: playlist.Name,
+				Owner:        playlist.Owner.ID,
+				Error:        err.Error(),
+			})
 			continue
 		}
 
-		if playlist.Owner.ID != p.userID {
-			if p.cfg.IncludeOtherPlaylists {
-				log.Printf("Adding %d tracks from other user's playlist: %s", len(tracks), playlist.Name)
-				otherTracks = append(otherTracks, tracks...)
-			}
-		} else {
+		tracks := make([]TrackData, 0, len(fetched[i].items))
+		for _, item := range fetched[i].items {
+			data := p.createTrackData(playlist, item)
+			p.addCandidate(candidates, playlist, item, data)
+			tracks = append(tracks, data)
+		}
+		processed = append(processed, PlaylistInfo{
+			ID:         string(playlist.ID),
+			Name:       playlist.Name,
+			Owner:      playlist.Owner.ID,
+			SnapshotID: playlist.SnapshotID,
+		})
+		summaries = append(summaries, summarize(playlist, fetched[i].items))
+
+		if isOwn {
 			log.Printf("Adding %d tracks from your playlist: %s", len(tracks), playlist.Name)
 			userTracks = append(userTracks, tracks...)
+		} else {
+			log.Printf("Adding %d tracks from other user's playlist: %s", len(tracks), playlist.Name)
+			otherTracks = append(otherTracks, tracks...)
 		}
 	}
 
 	log.Printf("Processing complete. Found %d tracks in your playlists and %d tracks in other playlists",
 		len(userTracks), len(otherTracks))
+	if len(failed) > 0 {
+		log.Printf("%d playlists could not be processed", len(failed))
+	}
 
-	return map[string][]TrackData{
-		"user":  userTracks,
-		"other": otherTracks,
+	// Compare what Spotify says was played most with the top tracks playlists
+	var listening []ListeningTrack
+	if p.cfg.ListeningReport {
+		log.Println("Fetching your Spotify top tracks and recently played tracks...")
+		listening, err = p.listeningReport(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Rank the missing tracks of each year as candidates for its top tracks playlist
+	var suggestions map[string][]suggest.Suggestion
+	if p.cfg.Suggestions {
+		suggestions = suggest.Rank(candidates.list(), p.history != nil)
+		log.Printf("Ranked %d candidates for the top tracks playlists of %d years", len(candidates.order), len(suggestions))
+	}
+
+	return &Result{
+		Tracks: map[string][]TrackData{
+			"user":  userTracks,
+			"other": otherTracks,
+		},
+		Failed:          failed,
+		Playlists:       processed,
+		PossibleMatches: p.possibleMatches,
+		DataIssues:      p.dataIssues,
+		Summaries:       summaries,
+		Listening:       listening,
+		Suggestions:     suggestions,
 	}, nil
 }
 
-// collectTopTracks collects all tracks from top tracks playlists
-func (p *PlaylistProcessor) collectTopTracks() error {
-	playlists, err := p.getAllPlaylists()
-	if err != nil {
-		return err
+// playlistFetch holds the fetched items of one playlist, or the error that prevented it
+type playlistFetch struct {
+	items []spotify.PlaylistTrack
+	err   error
+}
+
+// fetchPlaylists fetches the tracks of the playlists that are needed using a pool of
+// cfg.Workers workers. Results are stored by playlist index, so their order does not
+// depend on which worker finishes first.
+func (p *PlaylistProcessor) fetchPlaylists(ctx context.Context, playlists []spotify.SimplePlaylist) ([]playlistFetch, error) {
+	var needed []int
+	for i, playlist := range playlists {
+		if playlist.Owner.ID == p.userID || p.cfg.IncludeOtherPlaylists || p.isTopTracksPlaylist(playlist) {
+			needed = append(needed, i)
+		}
+	}
+	log.Printf("Fetching tracks of %d playlists with %d workers...", len(needed), p.cfg.Workers)
+
+	results := make([]playlistFetch, len(playlists))
+	jobs := make(chan int)
+	var completed int32
+	var wg sync.WaitGroup
+	for w := 0; w < p.cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				items, err := p.playlistItems(ctx, playlists[i])
+				results[i] = playlistFetch{items: items, err: err}
+				log.Printf("Fetched playlist %d/%d: %s", atomic.AddInt32(&completed, 1), len(needed), playlists[i].Name)
+			}
+		}()
+	}
+
+	// Stop handing out playlists as soon as the run is cancelled
+feed:
+	for _, i := range needed {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
 	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("playlist processing cancelled: %v", err)
+	}
+	return results, nil
+}
+
+// collectTopTracks indexes the tracks of the fetched top tracks playlists by the
+// year of each playlist
+func (p *PlaylistProcessor) collectTopTracks(playlists []spotify.SimplePlaylist, fetched []playlistFetch) error {
+	p.topTracks = match.NewIndex(p.matchStrategies())
+	p.topTracksByYear = make(map[string]*match.Index)
+	p.topArtistsByYear = make(map[string]map[string]bool)
+
+	for i, playlist := range playlists {
+		if !p.isTopTracksPlaylist(playlist) {
+			continue
+		}
+		// Without every top tracks playlist, tracks would be marked as missing by mistake
+		if err := fetched[i].err; err != nil {
+			return fmt.Errorf("failed to fetch top tracks playlist %s: %v", playlist.Name, err)
+		}
+
+		year, _ := p.topTracksYear(playlist)
+		if year == "" {
+			log.Printf("Warning: no year found in top tracks playlist name %q; its tracks only appear in the Found In Top Tracks Playlist column", playlist.Name)
+		} else {
+			fmt.Printf("Processing top tracks playlist for %s: %s\n", year, playlist.Name)
+			if p.topTracksByYear[year] == nil {
+				p.topTracksByYear[year] = match.NewIndex(p.matchStrategies())
+				p.topArtistsByYear[year] = make(map[string]bool)
+			}
+		}
 
-	for _, playlist := range playlists {
-		normalizedName := normalizeQuotes(strings.ToLower(playlist.Name))
-		if strings.Contains(normalizedName, strings.ToLower(p.cfg.TopTracksPattern)) {
-			fmt.Printf("Processing top tracks playlist: %s\n", playlist.Name)
-			if err := p.processPlaylistTracks(playlist.ID, func(track spotify.FullTrack) {
-				p.topTracksMap[string(track.ID)] = TrackInfo{
-					ID:   string(track.ID),
-					Name: track.Name,
+		for _, item := range fetched[i].items {
+			if !p.isMusic(item) {
+				continue
+			}
+			track := match.FromSpotify(item.Track)
+			p.topTracks.Add(track, playlist.Name)
+			if year != "" {
+				p.topTracksByYear[year].Add(track, playlist.Name)
+				for _, artist := range track.Artists {
+					p.topArtistsByYear[year][match.NormalizeArtist(artist)] = true
 				}
-			}); err != nil {
-				return err
 			}
 		}
 	}
 
-	fmt.Printf("Found %d unique tracks in top tracks playlists\n", len(p.topTracksMap))
+	fmt.Printf("Found %d unique tracks in top tracks playlists for %d years\n", p.topTracks.Len(), len(p.topTracksByYear))
+
+	// Every track from a year without a top tracks playlist will be marked
+	for year := p.cfg.StartYear; year <= p.cfg.EndYear; year++ {
+		if p.topTracksByYear[strconv.Itoa(year)] == nil {
+			log.Printf("Warning: no top tracks playlist found for %d", year)
+		}
+	}
 	return nil
 }
 
 // getAllPlaylists retrieves all playlists with pagination
-func (p *PlaylistProcessor) getAllPlaylists() ([]spotify.SimplePlaylist, error) {
+func (p *PlaylistProcessor) getAllPlaylists(ctx context.Context) ([]spotify.SimplePlaylist, error) {
 	var allPlaylists []spotify.SimplePlaylist
 	offset := 0
 	limit := 50 // Maximum allowed by Spotify API
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("playlist processing cancelled: %v", err)
+		}
+
 		playlists, err := p.client.CurrentUsersPlaylistsOpt(&spotify.Options{
 			Limit:  &limit,
 			Offset: &offset,
@@ -141,66 +420,211 @@ func (p *PlaylistProcessor) getAllPlaylists() ([]spotify.SimplePlaylist, error)
 	return allPlaylists, nil
 }
 
-// processPlaylist processes a single playlist and returns its track data
-func (p *PlaylistProcessor) processPlaylist(playlist spotify.SimplePlaylist) ([]TrackData, error) {
-	log.Printf("Starting to process playlist: %s", playlist.Name)
-	var tracks []TrackData
-	err := p.processPlaylistTracks(playlist.ID, func(track spotify.FullTrack) {
-		tracks = append(tracks, p.createTrackData(playlist.Name, track))
-	})
+// playlistItems returns the items of a playlist from the cache if its snapshot and
+// the market are unchanged, and otherwise fetches them and updates the cache
+func (p *PlaylistProcessor) playlistItems(ctx context.Context, playlist spotify.SimplePlaylist) ([]spotify.PlaylistTrack, error) {
+	if p.cache != nil && !p.cfg.ForceRefresh {
+		if items, ok := p.cache.Get(string(playlist.ID), playlist.SnapshotID, p.cfg.Market); ok {
+			log.Printf("Using cached tracks for playlist %s (snapshot %s)", playlist.Name, playlist.SnapshotID)
+			return items, nil
+		}
+	}
+
+	items, err := p.fetchPlaylistTracks(ctx, playlist)
 	if err != nil {
-		return nil, fmt.Errorf("failed to process playlist %s: %v", playlist.Name, err)
+		return nil, err
 	}
-	log.Printf("Finished processing playlist %s: found %d tracks", playlist.Name, len(tracks))
-	return tracks, nil
+
+	if p.cache != nil {
+		if err := p.cache.Put(string(playlist.ID), playlist.SnapshotID, p.cfg.Market, items); err != nil {
+			log.Printf("Warning: failed to cache playlist %s: %v", playlist.Name, err)
+		}
+	}
+	return items, nil
 }
 
-// processPlaylistTracks processes all tracks in a playlist with pagination
-func (p *PlaylistProcessor) processPlaylistTracks(playlistID spotify.ID, processTrack func(spotify.FullTrack)) error {
+// fetchPlaylistTracks retrieves all items in a playlist with pagination
+func (p *PlaylistProcessor) fetchPlaylistTracks(ctx context.Context, playlist spotify.SimplePlaylist) ([]spotify.PlaylistTrack, error) {
+	var tracks []spotify.PlaylistTrack
 	offset := 0
 	limit := 100 // Maximum allowed by Spotify API
-	totalProcessed := 0
 
 	for {
-		log.Printf("Fetching tracks from playlist (offset: %d, limit: %d)...", offset, limit)
-		tracks, err := p.client.GetPlaylistTracksOpt(playlistID, &spotify.Options{
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		log.Printf("Fetching tracks from playlist %s (offset: %d, limit: %d)...", playlist.Name, offset, limit)
+		opt := &spotify.Options{
 			Limit:  &limit,
 			Offset: &offset,
-		}, "")
+		}
+		// With a market, Spotify reports whether each track can be played there
+		if p.cfg.Market != "" {
+			opt.Country = &p.cfg.Market
+		}
+		page, err := p.client.GetPlaylistTracksOpt(playlist.ID, opt, "")
 		if err != nil {
-			return fmt.Errorf("failed to get tracks: %v", err)
+			return nil, fmt.Errorf("failed to get tracks: %v", err)
 		}
 
-		log.Printf("Processing %d tracks from current batch...", len(tracks.Tracks))
-		for _, item := range tracks.Tracks {
-			processTrack(item.Track)
-			totalProcessed++
-		}
+		tracks = append(tracks, page.Tracks...)
 
-		if len(tracks.Tracks) < limit {
+		if len(page.Tracks) < limit {
 			break
 		}
 
 		offset += limit
 	}
 
-	log.Printf("Finished processing all tracks from playlist. Total tracks processed: %d", totalProcessed)
-	return nil
+	log.Printf("Finished fetching playlist %s: found %d tracks", playlist.Name, len(tracks))
+	return tracks, nil
 }
 
 // TrackData represents processed track information
 type TrackData struct {
-	PlaylistName   string
-	TrackName      string
-	Artists        string
-	Album          string
-	ReleaseDate    string
-	ReleaseYear    string
+	PlaylistID   string
+	PlaylistName string
+	TrackID      string
+	TrackName    string
+	Artists      string
+	Album        string
+	// ItemType is the kind of playlist item: track, episode or local
+	ItemType string
+	// Availability tells whether the item can be played: available, unavailable or region_restricted
+	Availability string
+	ReleaseDate  string
+	// DatePrecision is the precision of ReleaseDate: year, month or day
+	DatePrecision string
+	ReleaseYear   string
+	// YearSource tells where the release year came from: the album, an override or the earliest release
+	YearSource     string
 	NotInTopTracks string
+	// FoundInTopTracks names the top tracks playlists of other years a marked track is in
+	FoundInTopTracks string
+	// MatchStrategy names the strategy that matched the track to a top tracks playlist
+	MatchStrategy string
+	// MatchScore is the similarity of a fuzzy match, from 0 to 1
+	MatchScore string
+	// PlayCount and MinutesPlayed total the track's plays in the imported streaming
+	// history; both are empty when no history is imported
+	PlayCount     string
+	MinutesPlayed string
 }
 
-// createTrackData creates a TrackData object from a Spotify track
-func (p *PlaylistProcessor) createTrackData(playlistName string, track spotify.FullTrack) TrackData {
+// Values of TrackData.NotInTopTracks for marked tracks
+const (
+	// FlagMissing marks a track missing from the top tracks playlist of its release year
+	FlagMissing = "TRUE"
+	// FlagPossibleMatch marks a track with a near match in that playlist that awaits review
+	FlagPossibleMatch = "POSSIBLE_MATCH"
+)
+
+// Flagged reports whether the track is marked as missing or possibly missing from
+// the top tracks playlist of its release year
+func (t TrackData) Flagged() bool {
+	return t.NotInTopTracks != ""
+}
+
+// createTrackData creates a TrackData object from a playlist item
+func (p *PlaylistProcessor) createTrackData(playlist spotify.SimplePlaylist, item spotify.PlaylistTrack) TrackData {
+	track := item.Track
+
+	// The album date is wrong for songs on compilations and reissues, so it can be replaced
+	year, err := p.releaseYear(track)
+	releaseYear := year.year
+	// Only catalog tracks have an album date; episodes, local files and missing items don't
+	itemType, availability := classifyItem(item)
+	if err != nil && itemType == ItemTrack && availability != AvailabilityUnavailable {
+		p.dataIssues = append(p.dataIssues, DataIssue{
+			PlaylistName: playlist.Name,
+			TrackID:      string(track.ID),
+			TrackName:    track.Name,
+			Field:        "Release Date",
+			Value:        track.Album.ReleaseDate,
+			Problem:      err.Error(),
+		})
+	}
+
+	var matched topTracksMatch
+	if p.isMusic(item) {
+		matched = p.matchTopTracks(playlist.Name, track, releaseYear)
+	}
+
+	var playCount, minutesPlayed string
+	if p.history != nil && track.Name != "" {
+		plays := p.history.Lookup(match.FromSpotify(track), 0)
+		playCount = strconv.Itoa(plays.Plays)
+		minutesPlayed = strconv.FormatFloat(plays.Minutes(), 'f', 1, 64)
+	}
+
+	return TrackData{
+		PlaylistID:       string(playlist.ID),
+		PlaylistName:     playlist.Name,
+		TrackID:          string(track.ID),
+		TrackName:        track.Name,
+		Artists:          joinArtists(track),
+		Album:            track.Album.Name,
+		ItemType:         itemType,
+		Availability:     availability,
+		ReleaseDate:      track.Album.ReleaseDate,
+		DatePrecision:    year.precision,
+		ReleaseYear:      releaseYear,
+		YearSource:       year.source,
+		NotInTopTracks:   matched.notInTopTracks,
+		FoundInTopTracks: matched.foundInTopTracks,
+		MatchStrategy:    matched.strategy,
+		MatchScore:       matched.score,
+		PlayCount:        playCount,
+		MinutesPlayed:    minutesPlayed,
+	}
+}
+
+// topTracksMatch is the outcome of matching a track to the top tracks playlists
+type topTracksMatch struct {
+	notInTopTracks   string
+	foundInTopTracks string
+	strategy         string
+	score            string
+}
+
+// matchTopTracks matches a track to the top tracks playlist of its release year. A
+// track from the year range is marked if it is missing from that playlist, and a
+// near match is left for review under the name of the source the track came from.
+func (p *PlaylistProcessor) matchTopTracks(source string, track spotify.FullTrack, releaseYear string) topTracksMatch {
+	var matched topTracksMatch
+	if !inYearRange(p.cfg, releaseYear) {
+		return matched
+	}
+
+	candidate := match.FromSpotify(track)
+	if _, strategy := p.topTracksByYear[releaseYear].Lookup(candidate); strategy != "" {
+		matched.strategy = strategy
+		return matched
+	}
+	matched.notInTopTracks = FlagMissing
+	if playlists, strategy := p.topTracks.Lookup(candidate); strategy != "" {
+		matched.foundInTopTracks = strings.Join(playlists, ", ")
+		matched.strategy = strategy
+	}
+
+	// A near match is either confirmed in an earlier review or left for review
+	if near, ok := p.nearMatch(releaseYear, candidate); ok {
+		matched.strategy = match.StrategyFuzzy
+		matched.score = strconv.FormatFloat(near.Score, 'f', 2, 64)
+		if p.decisions.Get(candidate, near.Track) == match.DecisionConfirm {
+			matched.notInTopTracks = ""
+			matched.foundInTopTracks = ""
+		} else {
+			matched.notInTopTracks = FlagPossibleMatch
+			p.addPossibleMatch(source, candidate, near)
+		}
+	}
+	return matched
+}
+
+// joinArtists returns the names of a track's artists separated by commas
+func joinArtists(track spotify.FullTrack) string {
 	artists := ""
 	for i, artist := range track.Artists {
 		if i > 0 {
@@ -208,34 +632,21 @@ func (p *PlaylistProcessor) createTrackData(playlistName string, track spotify.F
 		}
 		artists += artist.Name
 	}
+	return artists
+}
 
-	releaseYear := ""
-	if track.Album.ReleaseDate != "" {
-		parts := strings.Split(track.Album.ReleaseDate, "-")
-		if len(parts) > 0 {
-			releaseYear = parts[0]
-		}
-	}
-
-	notInTopTracks := ""
-	if releaseYear != "" {
-		if releaseYear >= p.cfg.StartYear && releaseYear <= p.cfg.EndYear {
-			trackID := string(track.ID)
-			if _, exists := p.topTracksMap[trackID]; !exists {
-				notInTopTracks = "TRUE"
-			}
-		}
+// matchStrategies returns the configured strategies for matching tracks to top tracks playlists
+func (p *PlaylistProcessor) matchStrategies() []string {
+	if len(p.cfg.MatchStrategies) == 0 {
+		return match.DefaultStrategies
 	}
+	return p.cfg.MatchStrategies
+}
 
-	return TrackData{
-		PlaylistName:   playlistName,
-		TrackName:      track.Name,
-		Artists:        artists,
-		Album:          track.Album.Name,
-		ReleaseDate:    track.Album.ReleaseDate,
-		ReleaseYear:    releaseYear,
-		NotInTopTracks: notInTopTracks,
-	}
+// inYearRange reports whether a release year falls within the configured top tracks years
+func inYearRange(cfg *config.Config, releaseYear string) bool {
+	year, err := strconv.Atoi(releaseYear)
+	return err == nil && year >= cfg.StartYear && year <= cfg.EndYear
 }
 
 // normalizeQuotes replaces smart quotes with regular quotes
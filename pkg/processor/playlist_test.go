@@ -0,0 +1,244 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/zmb3/spotify"
+)
+
+// testConfig returns a configuration for processor tests
+func testConfig(workers int) *config.Config {
+	return &config.Config{
+		TopTracksPatterns: []*regexp.Regexp{regexp.MustCompile(`(?i)my top tracks of`)},
+		StartYear:         2020,
+		EndYear:           2025,
+		Workers:           workers,
+	}
+}
+
+// track creates a fixture track released on date
+func track(id, name, date string) spotify.FullTrack {
+	return spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{ID: spotify.ID(id), Name: name},
+		Album:       spotify.SimpleAlbum{Name: "Album", ReleaseDate: date},
+	}
+}
+
+func TestProcessPlaylistsOrderAndFlags(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", track("t1", "Kept", "2021-01-01"))
+	for i := 0; i < 20; i++ {
+		api.AddPlaylist(fmt.Sprintf("p%d", i), fmt.Sprintf("Playlist %d", i), "me",
+			track("t1", "Kept", "2021-01-01"), track(fmt.Sprintf("x%d", i), "Missing", "2022-05-01"))
+	}
+	api.AddPlaylist("theirs", "Their Mix", "friend", track("t2", "Other", "2021-01-01"))
+
+	p, err := NewPlaylistProcessor(api, testConfig(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := result.Tracks["user"]
+	if len(user) != 41 {
+		t.Fatalf("expected 41 user tracks, got %d", len(user))
+	}
+	for i := 0; i < 20; i++ {
+		kept, missing := user[1+2*i], user[2+2*i]
+		if kept.PlaylistName != fmt.Sprintf("Playlist %d", i) || kept.NotInTopTracks != "" || missing.NotInTopTracks != "TRUE" {
+			t.Fatalf("unexpected tracks for playlist %d: %+v %+v", i, kept, missing)
+		}
+	}
+	if len(result.Tracks["other"]) != 0 {
+		t.Errorf("expected other playlists to be skipped, got %d tracks", len(result.Tracks["other"]))
+	}
+}
+
+func TestProcessPlaylistsPaged(t *testing.T) {
+	// A playlist longer than one page of 100 tracks, half of it in the 2021 top tracks
+	api := NewFakeSpotify("me")
+	var tracks, top []spotify.FullTrack
+	for i := 0; i < 250; i++ {
+		tr := track(fmt.Sprintf("t%d", i), fmt.Sprintf("Song %d", i), "2021-03-01")
+		tracks = append(tracks, tr)
+		if i%2 == 0 {
+			top = append(top, tr)
+		}
+	}
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", top...)
+	api.AddPlaylist("long", "Long Playlist", "me", tracks...)
+
+	p, err := NewPlaylistProcessor(api, testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var long []TrackData
+	for _, data := range result.Tracks["user"] {
+		if data.PlaylistName == "Long Playlist" {
+			long = append(long, data)
+		}
+	}
+	if len(long) != 250 {
+		t.Fatalf("expected every page of the playlist, got %d tracks", len(long))
+	}
+	for i, data := range long {
+		missing := i%2 == 1
+		if data.TrackName != fmt.Sprintf("Song %d", i) || data.ReleaseYear != "2021" || (data.NotInTopTracks == FlagMissing) != missing {
+			t.Fatalf("unexpected track %d: %+v", i, data)
+		}
+	}
+}
+
+func TestProcessPlaylistsFailures(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", track("t1", "Kept", "2021-01-01"))
+	api.AddPlaylist("broken", "Broken", "me", track("t2", "Lost", "2021-01-01"))
+	api.FailPlaylist("broken", fmt.Errorf("boom"))
+
+	p, err := NewPlaylistProcessor(api, testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].PlaylistID != "broken" {
+		t.Errorf("expected the broken playlist to be reported, got %+v", result.Failed)
+	}
+
+	// A failed top tracks playlist fails the run rather than mis-flagging tracks
+	api.FailPlaylist("top", fmt.Errorf("boom"))
+	if _, err := p.ProcessPlaylists(context.Background()); err == nil {
+		t.Error("expected an error when a top tracks playlist fails")
+	}
+}
+
+func TestProcessPlaylistsCancelled(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("p1", "Playlist", "me", track("t1", "Song", "2021-01-01"))
+
+	p, err := NewPlaylistProcessor(api, testConfig(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.ProcessPlaylists(ctx); err == nil {
+		t.Error("expected a cancelled run to fail")
+	}
+}
+
+func TestProcessPlaylistsPerYear(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top21", "My Top Tracks of 2021", "me", track("a", "In 2021", "2021-01-01"))
+	api.AddPlaylist("top22", "My Top Tracks of 2022", "me", track("b", "Late", "2021-06-01"))
+	api.AddPlaylist("mix", "Mix", "me", track("a", "In 2021", "2021-01-01"), track("b", "Late", "2021-06-01"))
+
+	p, err := NewPlaylistProcessor(api, testConfig(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mix := result.Tracks["user"][2:]
+	if mix[0].NotInTopTracks != "" {
+		t.Errorf("expected a track in its own year's playlist not to be marked: %+v", mix[0])
+	}
+	if mix[1].NotInTopTracks != "TRUE" || mix[1].FoundInTopTracks != "My Top Tracks of 2022" {
+		t.Errorf("expected a track in another year's playlist to be marked with that playlist: %+v", mix[1])
+	}
+}
+
+func TestProcessPlaylistsLibrary(t *testing.T) {
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", track("t1", "Kept", "2021-01-01"))
+	api.AddSavedTrack(track("t1", "Kept", "2021-01-01"), track("t2", "Liked", "2021-03-01"))
+
+	// A long album needs more requests than the first page of tracks saved albums come with
+	album := spotify.SimpleAlbum{ID: "al1", Name: "My Top Tracks of 2021", ReleaseDate: "2021-05-01", ReleaseDatePrecision: "day"}
+	var tracks []spotify.SimpleTrack
+	for i := 0; i < 60; i++ {
+		tracks = append(tracks, spotify.SimpleTrack{ID: spotify.ID(fmt.Sprintf("al1-%d", i)), Name: fmt.Sprintf("Side %d", i)})
+	}
+	api.AddSavedAlbum(album, tracks...)
+
+	cfg := testConfig(1)
+	cfg.IncludeLikedSongs = true
+	cfg.IncludeSavedAlbums = true
+	p, err := NewPlaylistProcessor(api, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := result.Tracks["user"]
+	if len(user) != 63 {
+		t.Fatalf("expected 63 user tracks, got %d", len(user))
+	}
+	if liked := user[1:3]; liked[0].PlaylistName != LikedSongsName || liked[0].NotInTopTracks != "" || liked[1].NotInTopTracks != "TRUE" {
+		t.Errorf("unexpected liked songs: %+v", liked)
+	}
+	// The album is not mistaken for a top tracks playlist because of its name
+	last := user[len(user)-1]
+	if last.PlaylistID != "album:al1" || last.PlaylistName != "Album: My Top Tracks of 2021" || last.ReleaseYear != "2021" || last.NotInTopTracks != "TRUE" {
+		t.Errorf("unexpected album track: %+v", last)
+	}
+}
+
+func TestProcessPlaylistsAlbumISRC(t *testing.T) {
+	// The 2021 top tracks hold the single; the saved album has the same recording under another ID
+	single := track("single", "Golden Hour", "2021-02-01")
+	single.ExternalIDs = map[string]string{"isrc": "USAAA2100001"}
+	api := NewFakeSpotify("me")
+	api.AddPlaylist("top", "My Top Tracks of 2021", "me", single)
+
+	album := spotify.SimpleAlbum{ID: "al1", Name: "Golden", ReleaseDate: "2021-05-01", ReleaseDatePrecision: "day"}
+	api.AddSavedAlbum(album,
+		spotify.SimpleTrack{ID: "al1-1", Name: "Golden Hour"},
+		spotify.SimpleTrack{ID: "al1-2", Name: "Deep Cut"})
+	// Only the full track carries the ISRC
+	onAlbum := track("al1-1", "Golden Hour", "2021-05-01")
+	onAlbum.ExternalIDs = map[string]string{"isrc": "usaaa2100001"}
+	api.AddCatalogTrack(onAlbum)
+
+	cfg := testConfig(1)
+	cfg.IncludeSavedAlbums = true
+	p, err := NewPlaylistProcessor(api, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.ProcessPlaylists(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	albumTracks := result.Tracks["user"][1:]
+	if len(albumTracks) != 2 {
+		t.Fatalf("expected 2 album tracks, got %+v", albumTracks)
+	}
+	if matched := albumTracks[0]; matched.NotInTopTracks != "" || matched.MatchStrategy != "isrc" || matched.Album != "Golden" {
+		t.Errorf("expected the album track to match the single by ISRC: %+v", matched)
+	}
+	if missing := albumTracks[1]; missing.NotInTopTracks != FlagMissing {
+		t.Errorf("expected the other album track to be missing: %+v", missing)
+	}
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/mikev/spotify-analysis/pkg/releaseyear"
+	"github.com/zmb3/spotify"
+)
+
+// trackYear is the year a track counts for, where that year came from and the
+// precision of the track's album release date
+type trackYear struct {
+	year      string
+	source    string
+	precision string
+}
+
+// releaseYear returns the year a track counts for: an override, the earliest release
+// of the same recording, or the year of the track's album. It also returns the problem
+// with the album's release date, if any, unless an override makes the date irrelevant.
+func (p *PlaylistProcessor) releaseYear(track spotify.FullTrack) (trackYear, error) {
+	albumYear, precision, dateErr := releaseyear.ParseDate(track.Album.ReleaseDate, track.Album.ReleaseDatePrecision)
+
+	isrc := match.FromSpotify(track).ISRC
+	if year, ok := p.yearOverrides.Lookup(string(track.ID), isrc); ok {
+		return trackYear{year: year, source: releaseyear.SourceOverride, precision: precision}, nil
+	}
+
+	year := ""
+	if dateErr == nil {
+		year = strconv.Itoa(albumYear)
+	}
+	if earliest := p.earliestYears[isrc]; earliest != "" && isrc != "" && (year == "" || earliest < year) {
+		return trackYear{year: earliest, source: releaseyear.SourceEarliestISRC, precision: precision}, dateErr
+	}
+	if year == "" {
+		return trackYear{precision: precision}, dateErr
+	}
+	return trackYear{year: year, source: releaseyear.SourceAlbum, precision: precision}, nil
+}
+
+// findEarliestYears searches for the other releases of every recording in the processed
+// playlists that could count for a year of the range, and keeps the earliest album year
+// of each. Years found in earlier runs are reused from the cache.
+func (p *PlaylistProcessor) findEarliestYears(ctx context.Context, playlists []spotify.SimplePlaylist, fetched []playlistFetch) error {
+	p.earliestYears = make(map[string]string)
+	if p.cache != nil && !p.cfg.ForceRefresh {
+		p.earliestYears = p.cache.ReleaseYears()
+	}
+
+	// Only tracks released in or after the first year of the range can move into it
+	var isrcs []string
+	seen := make(map[string]bool)
+	for i, playlist := range playlists {
+		if playlist.Owner.ID != p.userID && !p.cfg.IncludeOtherPlaylists {
+			continue
+		}
+		for _, item := range fetched[i].items {
+			if !p.isMusic(item) {
+				continue
+			}
+			isrc := match.FromSpotify(item.Track).ISRC
+			year, _, err := releaseyear.ParseDate(item.Track.Album.ReleaseDate, item.Track.Album.ReleaseDatePrecision)
+			if isrc == "" || seen[isrc] || (err == nil && year < p.cfg.StartYear) {
+				continue
+			}
+			if _, ok := p.yearOverrides.Lookup(string(item.Track.ID), isrc); ok {
+				continue
+			}
+			seen[isrc] = true
+			if _, cached := p.earliestYears[isrc]; !cached {
+				isrcs = append(isrcs, isrc)
+			}
+		}
+	}
+
+	log.Printf("Searching for the earliest release of %d recordings (%d known from earlier runs)...", len(isrcs), len(seen)-len(isrcs))
+	failed := 0
+	for _, isrc := range isrcs {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("release year search cancelled: %v", err)
+		}
+		year, err := p.searchEarliestYear(isrc)
+		if err != nil {
+			// The album year is still a reasonable answer, so a failed search is not fatal
+			log.Printf("Warning: failed to search for releases of ISRC %s: %v", isrc, err)
+			failed++
+			continue
+		}
+		// An empty year is kept too, so a recording without a usable date is not searched again
+		p.earliestYears[isrc] = year
+	}
+	if failed > 0 {
+		log.Printf("%d release searches failed; those tracks use their album year", failed)
+	}
+
+	if p.cache != nil {
+		if err := p.cache.SaveReleaseYears(p.earliestYears); err != nil {
+			log.Printf("Warning: failed to cache release years: %v", err)
+		}
+	}
+	return nil
+}
+
+// searchEarliestYear returns the earliest album year among the tracks with an ISRC
+func (p *PlaylistProcessor) searchEarliestYear(isrc string) (string, error) {
+	limit := 50
+	result, err := p.client.SearchOpt("isrc:"+isrc, spotify.SearchTypeTrack, &spotify.Options{Limit: &limit})
+	if err != nil {
+		return "", err
+	}
+	if result.Tracks == nil {
+		return "", nil
+	}
+
+	earliest := 0
+	for _, track := range result.Tracks.Tracks {
+		// Search can return similar recordings too, so only exact ISRC matches count
+		if match.FromSpotify(track).ISRC != isrc {
+			continue
+		}
+		year, _, err := releaseyear.ParseDate(track.Album.ReleaseDate, track.Album.ReleaseDatePrecision)
+		if err == nil && (earliest == 0 || year < earliest) {
+			earliest = year
+		}
+	}
+	if earliest == 0 {
+		return "", nil
+	}
+	return strconv.Itoa(earliest), nil
+}
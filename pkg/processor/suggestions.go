@@ -0,0 +1,81 @@
+package processor
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+	"github.com/mikev/spotify-analysis/pkg/suggest"
+	"github.com/zmb3/spotify"
+)
+
+// candidateSet collects the tracks missing from the top tracks playlist of their
+// release year, once per track, in the order they are first found
+type candidateSet struct {
+	byKey map[string]*suggest.Candidate
+	order []string
+}
+
+// newCandidateSet creates an empty candidate set
+func newCandidateSet() *candidateSet {
+	return &candidateSet{byKey: make(map[string]*suggest.Candidate)}
+}
+
+// addCandidate records a processed playlist item if it is missing from the top
+// tracks playlist of its release year. Tracks awaiting a match review are left out,
+// since they may already be in the playlist as another release.
+func (p *PlaylistProcessor) addCandidate(set *candidateSet, playlist spotify.SimplePlaylist, item spotify.PlaylistTrack, data TrackData) {
+	if !p.cfg.Suggestions || data.NotInTopTracks != FlagMissing {
+		return
+	}
+
+	key := data.TrackID
+	if key == "" {
+		key = data.TrackName + "|" + data.Artists
+	}
+	candidate := set.byKey[key]
+	if candidate == nil {
+		candidate = &suggest.Candidate{
+			TrackID:           data.TrackID,
+			TrackName:         data.TrackName,
+			Artists:           data.Artists,
+			Album:             data.Album,
+			ReleaseYear:       data.ReleaseYear,
+			ArtistInTopTracks: p.artistInTopTracks(item.Track, data.ReleaseYear),
+		}
+		// Only the plays in the release year show how much the track was part of that year
+		if year, err := strconv.Atoi(data.ReleaseYear); p.history != nil && err == nil {
+			candidate.Plays = p.history.Lookup(match.FromSpotify(item.Track), year).Plays
+		}
+		set.byKey[key] = candidate
+		set.order = append(set.order, key)
+	}
+
+	candidate.Playlists = match.AppendUnique(candidate.Playlists, playlist.Name)
+	// Spotify reports no date for items of very old playlists
+	if added, err := time.Parse(time.RFC3339, item.AddedAt); err == nil {
+		if candidate.FirstAdded.IsZero() || added.Before(candidate.FirstAdded) {
+			candidate.FirstAdded = added
+		}
+	}
+}
+
+// list returns the candidates in the order they were found
+func (set *candidateSet) list() []suggest.Candidate {
+	candidates := make([]suggest.Candidate, 0, len(set.order))
+	for _, key := range set.order {
+		candidates = append(candidates, *set.byKey[key])
+	}
+	return candidates
+}
+
+// artistInTopTracks reports whether one of a track's artists is in the top tracks
+// playlist of a year
+func (p *PlaylistProcessor) artistInTopTracks(track spotify.FullTrack, year string) bool {
+	for _, artist := range track.Artists {
+		if p.topArtistsByYear[year][match.NormalizeArtist(artist.Name)] {
+			return true
+		}
+	}
+	return false
+}
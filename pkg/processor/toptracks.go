@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/zmb3/spotify"
+)
+
+// defaultYearRegex is used when the configuration has no year regex
+var defaultYearRegex = regexp.MustCompile(config.DefaultTopTracksYearRegex)
+
+// isTopTracksPlaylist reports whether a playlist is a top tracks playlist
+func (p *PlaylistProcessor) isTopTracksPlaylist(playlist spotify.SimplePlaylist) bool {
+	_, ok := p.topTracksYear(playlist)
+	return ok
+}
+
+// topTracksYear reports whether a playlist is a top tracks playlist, either because
+// its ID is on the allow-list or because its name matches one of the patterns, and
+// returns its year. The year set for an allowed ID comes first, then the "year" group
+// of the matching pattern, then the year regex applied to the name. The year is
+// empty if none of them finds one.
+func (p *PlaylistProcessor) topTracksYear(playlist spotify.SimplePlaylist) (string, bool) {
+	// An album named like a top tracks playlist is still just an album
+	if isLibrary(playlist) {
+		return "", false
+	}
+	name := normalizeQuotes(playlist.Name)
+
+	if year, allowed := p.cfg.TopTracksPlaylistIDs[string(playlist.ID)]; allowed {
+		if year == "" {
+			year = p.playlistYear(name)
+		}
+		return year, true
+	}
+
+	for _, pattern := range p.cfg.TopTracksPatterns {
+		match := pattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if i := pattern.SubexpIndex("year"); i > 0 && match[i] != "" {
+			return expandYear(match[i]), true
+		}
+		return p.playlistYear(name), true
+	}
+	return "", false
+}
+
+// playlistYear extracts the year from a top tracks playlist name using the configured
+// regular expression: its "year" group if it has one, otherwise its first non-empty group
+func (p *PlaylistProcessor) playlistYear(name string) string {
+	re := p.cfg.TopTracksYearRegex
+	if re == nil {
+		re = defaultYearRegex
+	}
+	match := re.FindStringSubmatch(normalizeQuotes(name))
+	if match == nil {
+		return ""
+	}
+	if i := re.SubexpIndex("year"); i > 0 {
+		return expandYear(match[i])
+	}
+	for _, group := range match[1:] {
+		if group != "" {
+			return expandYear(group)
+		}
+	}
+	return ""
+}
+
+// expandYear turns a two-digit year such as the "21" of "best of '21" into a
+// four-digit one: years up to the current year are in this century, later ones
+// in the previous century
+func expandYear(year string) string {
+	if len(year) != 2 {
+		return year
+	}
+	n, err := strconv.Atoi(year)
+	if err != nil {
+		return year
+	}
+	if n <= time.Now().Year()%100 {
+		return strconv.Itoa(2000 + n)
+	}
+	return strconv.Itoa(1900 + n)
+}
@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+// playlist creates a fixture playlist
+func playlist(id, name string) spotify.SimplePlaylist {
+	return spotify.SimplePlaylist{ID: spotify.ID(id), Name: name}
+}
+
+func TestTopTracksYear(t *testing.T) {
+	cfg := testConfig(1)
+	cfg.TopTracksPatterns = append(cfg.TopTracksPatterns,
+		regexp.MustCompile(`(?i)^top tracks of (?P<year>\d{4})$`),
+		regexp.MustCompile(`(?i)^jp's best of`),
+	)
+	cfg.TopTracksPlaylistIDs = map[string]string{"pinned": "2018", "unnamed": ""}
+	p := &PlaylistProcessor{cfg: cfg}
+
+	tests := []struct {
+		playlist spotify.SimplePlaylist
+		year     string
+		ok       bool
+	}{
+		{playlist("a", "My Top Tracks of 2021"), "2021", true},
+		{playlist("b", "Top Tracks of 2019"), "2019", true},
+		{playlist("c", "jp’s best of '21"), "2021", true},
+		{playlist("d", "jp's best of '99"), "1999", true},
+		{playlist("e", "My Top Tracks of all time"), "", true},
+		{playlist("pinned", "Favourites"), "2018", true},
+		{playlist("unnamed", "Road Trip 2017"), "2017", true},
+		{playlist("f", "Road Trip 2017"), "", false},
+	}
+	for _, test := range tests {
+		year, ok := p.topTracksYear(test.playlist)
+		if year != test.year || ok != test.ok {
+			t.Errorf("topTracksYear(%q) = %q, %v, want %q, %v", test.playlist.Name, year, ok, test.year, test.ok)
+		}
+	}
+}
+
+func TestPlaylistYear(t *testing.T) {
+	p := &PlaylistProcessor{cfg: testConfig(1)}
+	tests := map[string]string{
+		"My Top Tracks of 2021": "2021",
+		"Your Top Songs 1999":   "1999",
+		"Best of '05":           "2005",
+		"Top Tracks (all time)": "",
+		"Top 500 Tracks":        "",
+	}
+	for name, want := range tests {
+		if got := p.playlistYear(name); got != want {
+			t.Errorf("playlistYear(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	p.cfg.TopTracksYearRegex = regexp.MustCompile(`Top (?P<year>\d{4})`)
+	if got := p.playlistYear("Best of 2019 - Top 2020"); got != "2020" {
+		t.Errorf("expected the named year group to be used, got %q", got)
+	}
+}
@@ -0,0 +1,142 @@
+// Package releaseyear decides which year a track was released in. Spotify only
+// knows the release date of a track's album, which for compilations and reissues
+// is years after the song first came out, so the album year can be replaced by a
+// user-maintained override or by the earliest album year of the same recording.
+package releaseyear
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources of a track's release year
+const (
+	// SourceAlbum is the release date of the track's album
+	SourceAlbum = "album"
+	// SourceOverride is an entry in the override file
+	SourceOverride = "override"
+	// SourceEarliestISRC is the earliest album release date among releases with the same ISRC
+	SourceEarliestISRC = "earliest_isrc"
+)
+
+// Precisions of an album release date, as reported by Spotify
+const (
+	PrecisionYear  = "year"
+	PrecisionMonth = "month"
+	PrecisionDay   = "day"
+)
+
+// MinYear is the earliest plausible album release year. Spotify reports unknown
+// dates as "0000" and occasionally other placeholder years.
+const MinYear = 1900
+
+// dateLayouts holds the layout of a release date for each precision
+var dateLayouts = map[string]string{
+	PrecisionYear:  "2006",
+	PrecisionMonth: "2006-01",
+	PrecisionDay:   "2006-01-02",
+}
+
+// ParseDate validates an album release date against its precision and returns its
+// year and precision. A missing precision is inferred from the date's length. The
+// error describes what is wrong with a missing, malformed or implausible date.
+func ParseDate(date, precision string) (int, string, error) {
+	if date == "" {
+		return 0, precision, fmt.Errorf("missing release date")
+	}
+	if precision == "" {
+		for p, layout := range dateLayouts {
+			if len(layout) == len(date) {
+				precision = p
+			}
+		}
+	}
+	layout, known := dateLayouts[precision]
+	if !known {
+		return 0, precision, fmt.Errorf("release date %q has an unknown precision %q", date, precision)
+	}
+
+	parsed, err := time.Parse(layout, date)
+	if err != nil {
+		return 0, precision, fmt.Errorf("release date %q does not match its precision %q", date, precision)
+	}
+	if year := parsed.Year(); year < MinYear || year > time.Now().Year()+1 {
+		return 0, precision, fmt.Errorf("release date %q has an implausible year", date)
+	}
+	return parsed.Year(), precision, nil
+}
+
+// Overrides maps track IDs and ISRCs to the year the track should be counted in
+type Overrides map[string]string
+
+// LoadOverrides reads an override file: a CSV file with a header row whose first
+// column is a track ID or an ISRC and whose second column is a four-digit year.
+// Further columns, such as a note, are ignored, and lines starting with # are
+// comments. A missing file holds no overrides.
+func LoadOverrides(path string) (Overrides, error) {
+	overrides := make(Overrides)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open release year overrides: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	header := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse release year overrides %s: %v", path, err)
+		}
+		if header {
+			header = false
+			continue
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("invalid release year override %q in %s: expected an ID and a year", strings.Join(record, ","), path)
+		}
+
+		id, year := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if id == "" && year == "" {
+			continue
+		}
+		if id == "" || !IsYear(year) {
+			return nil, fmt.Errorf("invalid release year override %q in %s: expected an ID and a four-digit year", strings.Join(record, ","), path)
+		}
+		overrides[id] = year
+	}
+	return overrides, nil
+}
+
+// Lookup returns the year set for a track by its ID or, failing that, its ISRC
+func (o Overrides) Lookup(trackID, isrc string) (string, bool) {
+	if year, exists := o[trackID]; exists && trackID != "" {
+		return year, true
+	}
+	if year, exists := o[isrc]; exists && isrc != "" {
+		return year, true
+	}
+	return "", false
+}
+
+// IsYear reports whether s is a four-digit year
+func IsYear(s string) bool {
+	if len(s) != 4 {
+		return false
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
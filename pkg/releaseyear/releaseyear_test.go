@@ -0,0 +1,72 @@
+package releaseyear
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.csv")
+	content := "ID,Year,Note\n# comment\n4uLU6hMCjMI75M1A2tKUQC,1975,Greatest Hits\nGBAYE7500101, 1975 \n,\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides, err := LoadOverrides(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if year, ok := overrides.Lookup("4uLU6hMCjMI75M1A2tKUQC", ""); !ok || year != "1975" {
+		t.Errorf("expected the track ID override, got %q, %v", year, ok)
+	}
+	if year, ok := overrides.Lookup("other", "GBAYE7500101"); !ok || year != "1975" {
+		t.Errorf("expected the ISRC override, got %q, %v", year, ok)
+	}
+	if _, ok := overrides.Lookup("other", ""); ok {
+		t.Error("expected no override for an unknown track")
+	}
+
+	// A missing file holds no overrides
+	if overrides, err := LoadOverrides(filepath.Join(t.TempDir(), "missing.csv")); err != nil || len(overrides) != 0 {
+		t.Errorf("expected no overrides, got %v, %v", overrides, err)
+	}
+
+	for _, content := range []string{"ID,Year\ntrack,75\n", "ID,Year\ntrack\n", "ID,Year\n,1975\n"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadOverrides(path); err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		date, precision string
+		wantYear        int
+		wantPrecision   string
+		wantErr         bool
+	}{
+		{"2021-03-05", PrecisionDay, 2021, PrecisionDay, false},
+		{"2021-03", PrecisionMonth, 2021, PrecisionMonth, false},
+		{"1975", PrecisionYear, 1975, PrecisionYear, false},
+		{"2021-03", "", 2021, PrecisionMonth, false},
+		{"2021", PrecisionDay, 0, PrecisionDay, true},
+		{"2021-13", PrecisionMonth, 0, PrecisionMonth, true},
+		{"0000", PrecisionYear, 0, PrecisionYear, true},
+		{"2021", "decade", 0, "decade", true},
+		{"", PrecisionYear, 0, PrecisionYear, true},
+	}
+	for _, tt := range tests {
+		year, precision, err := ParseDate(tt.date, tt.precision)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDate(%q, %q) error = %v, want error %v", tt.date, tt.precision, err, tt.wantErr)
+			continue
+		}
+		if year != tt.wantYear || precision != tt.wantPrecision {
+			t.Errorf("ParseDate(%q, %q) = %d, %q, want %d, %q", tt.date, tt.precision, year, precision, tt.wantYear, tt.wantPrecision)
+		}
+	}
+}
@@ -1,115 +1,379 @@
 package spotify
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/mikev/spotify-analysis/pkg/config"
 	"github.com/zmb3/spotify"
-)
-
-var (
-	auth  spotify.Authenticator
-	ch    = make(chan *spotify.Client)
-	state = "some-random-state-key"
+	"golang.org/x/oauth2"
 )
 
 // Client wraps the Spotify client with additional functionality
 type Client struct {
 	*spotify.Client
-	server     *http.Server
-	serverWg   sync.WaitGroup
-	serverOnce sync.Once
+	tokens      *TokenStore
+	retry       *retryTransport
+	cleanupOnce sync.Once
+}
+
+// Authenticator runs the OAuth login for a single Spotify account. Each
+// authenticator has its own callback mux, listener and result channel, so
+// several can be used in the same process.
+type Authenticator struct {
+	cfg     *config.Config
+	ctx     context.Context
+	oauth   *oauth2.Config
+	tokens  *TokenStore
+	retry   *retryTransport
+	login   loginState
+	results chan authResult
+	mux     *http.ServeMux
+}
+
+// NewClient creates a new authenticated Spotify client. A previously saved token
+// is reused (and refreshed if it has expired) before falling back to a browser login.
+// Cancelling ctx aborts the login and every later request made by the client.
+func NewClient(ctx context.Context, cfg *config.Config) (*Client, error) {
+	a, err := NewAuthenticator(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a.Login()
+}
+
+// NewAuthenticator creates an authenticator for the configured account. Its login
+// and the clients it creates stop when ctx is cancelled.
+func NewAuthenticator(ctx context.Context, cfg *config.Config) (*Authenticator, error) {
+	// HTTP client used for both token requests and API calls
+	var transport http.RoundTripper = http.DefaultTransport
+	if cfg.APIURL != "" {
+		rewrite, err := newRewriteTransport(cfg.APIURL)
+		if err != nil {
+			return nil, err
+		}
+		transport = rewrite
+	}
+	if cfg.RequestsPerSecond > 0 {
+		transport = newRateLimitTransport(transport, cfg.RequestsPerSecond)
+	}
+	retry := newRetryTransport(transport, cfg.MaxRetries, cfg.RetryBaseDelay, cfg.RetryMaxDelay)
+	client := &http.Client{Transport: &contextTransport{ctx: ctx, base: retry}}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+
+	a := &Authenticator{
+		cfg:     cfg,
+		ctx:     ctx,
+		retry:   retry,
+		oauth:   newOAuthConfig(cfg, scopes(cfg)...),
+		tokens:  NewTokenStore(cfg.TokenFile, cfg.TokenKey),
+		results: make(chan authResult, 1),
+		mux:     http.NewServeMux(),
+	}
+
+	// /login starts a fresh attempt after a failure
+	a.mux.HandleFunc("/callback", a.completeAuth)
+	a.mux.HandleFunc("/login", a.startLogin)
+
+	return a, nil
 }
 
-// NewClient creates a new authenticated Spotify client
-func NewClient(cfg *config.Config) (*Client, error) {
-	// Check and cleanup port before starting
-	if err := checkAndCleanupPort(cfg.Port); err != nil {
-		return nil, fmt.Errorf("failed to cleanup port: %v", err)
+// Handler returns the HTTP handler serving the login callback
+func (a *Authenticator) Handler() http.Handler {
+	return a.mux
+}
+
+// Login returns a client for the account, using the saved token if possible and
+// otherwise running the interactive login
+func (a *Authenticator) Login() (*Client, error) {
+	if a.cfg.Account != "" {
+		log.Printf("Logging in account %s", a.cfg.Account)
 	}
+	log.Printf("Using %s authorization flow", a.cfg.AuthFlow)
 
-	// Initialize the authenticator
-	auth = spotify.NewAuthenticator(cfg.RedirectURI, spotify.ScopePlaylistReadPrivate, spotify.ScopePlaylistReadCollaborative)
-	auth.SetAuthInfo(cfg.ClientID, cfg.ClientSecret)
+	// Try the saved token first
+	spotifyClient, err := a.clientFromStore()
+	if err != nil {
+		log.Printf("Saved token unusable, falling back to interactive login: %v", err)
+	}
+	if spotifyClient != nil {
+		log.Printf("Using saved token from %s", a.cfg.TokenFile)
+		return &Client{Client: spotifyClient, tokens: a.tokens, retry: a.retry}, nil
+	}
+
+	// Don't start an interactive login for a run that is already stopping
+	if err := a.ctx.Err(); err != nil {
+		return nil, fmt.Errorf("login cancelled: %v", err)
+	}
+
+	if a.cfg.Account != "" {
+		fmt.Printf("Log in with the Spotify account for %q\n", a.cfg.Account)
+	}
+
+	var tok *oauth2.Token
+	if a.cfg.Headless {
+		// Headless mode finishes the login through stdin, without a listener or browser
+		tok, err = a.headlessLoginContext(os.Stdin, os.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("headless login failed: %v", err)
+		}
+	} else {
+		tok, err = a.browserLogin()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client := &Client{Client: a.newSpotifyClient(tok), tokens: a.tokens, retry: a.retry}
+	if err := a.tokens.Save(tok); err != nil {
+		log.Printf("Warning: failed to save token: %v", err)
+	} else {
+		log.Printf("Saved token to %s", a.cfg.TokenFile)
+	}
+	return client, nil
+}
+
+// browserLogin runs the login through the local callback server
+func (a *Authenticator) browserLogin() (*oauth2.Token, error) {
+	// Bind the callback listener before starting the login so a port conflict is detected up front
+	listener, port, err := listenCallback(a.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if port != a.cfg.Port {
+		redirectURI, err := redirectURIWithPort(a.cfg.RedirectURI, port)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		log.Printf("Using redirect URI %s", redirectURI)
+		a.oauth.RedirectURL = redirectURI
+	}
+
+	url, err := a.beginLogin()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
 
 	// Create a new server with timeout
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Port),
+		Handler:      a.mux,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
-	// Create the client
-	client := &Client{
-		Client: nil,
-		server: server,
-	}
-
-	// Start local server to receive the callback
-	http.HandleFunc("/callback", client.completeAuth)
-
-	// Start server in a goroutine
-	client.serverWg.Add(1)
+	// Start server in a goroutine; it is only needed until the login completes
+	var serverWg sync.WaitGroup
+	serverWg.Add(1)
 	go func() {
-		defer client.serverWg.Done()
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		defer serverWg.Done()
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Printf("Server error: %v", err)
 		}
 	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error closing server: %v", err)
+		}
+		serverWg.Wait()
+	}()
 
 	// Open the browser for authentication
-	url := auth.AuthURL(state)
 	fmt.Println("Please log in to Spotify by visiting the following page in your browser:", url)
-	openBrowser(url)
+	if err := openBrowser(url); err != nil {
+		log.Printf("Could not open a browser (%v); open the URL above manually", err)
+	}
+
+	// Wait for auth to complete with timeout, allowing failed attempts to be retried
+	timeout := time.After(5 * time.Minute)
+	attempts := 0
+	for {
+		select {
+		case res := <-a.results:
+			if res.err == nil {
+				return res.token, nil
+			}
+			attempts++
+			if attempts >= a.cfg.AuthMaxAttempts {
+				return nil, fmt.Errorf("login failed after %d attempts: %v", attempts, res.err)
+			}
+			fmt.Printf("Login attempt %d/%d failed: %v\n", attempts, a.cfg.AuthMaxAttempts, res.err)
+			fmt.Printf("To try again, visit http://localhost:%d/login\n", port)
+		case <-timeout:
+			return nil, fmt.Errorf("authentication timed out after 5 minutes")
+		case <-a.ctx.Done():
+			return nil, fmt.Errorf("login cancelled: %v", a.ctx.Err())
+		}
+	}
+}
+
+// beginLogin starts a new login attempt and returns its authorization URL
+func (a *Authenticator) beginLogin() (string, error) {
+	var opts []oauth2.AuthCodeOption
+	if a.cfg.Account != "" {
+		// Always show the consent dialog so the browser session can switch accounts
+		opts = append(opts, oauth2.SetAuthURLParam("show_dialog", "true"))
+	}
+	return a.login.begin(a.oauth, a.cfg.AuthFlow == config.AuthFlowPKCE, opts...)
+}
+
+// clientFromStore builds a client from the saved token, refreshing it if needed.
+// It returns a nil client if there is no usable token.
+func (a *Authenticator) clientFromStore() (*spotify.Client, error) {
+	tok, err := a.tokens.Load()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if !tok.Valid() && tok.RefreshToken == "" {
+		return nil, fmt.Errorf("saved token has expired and has no refresh token")
+	}
+
+	client := a.newSpotifyClient(tok)
+
+	// Token refreshes the access token when it has expired
+	fresh, err := client.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh saved token: %v", err)
+	}
+	if fresh.AccessToken != tok.AccessToken {
+		log.Println("Refreshed expired access token")
+		// A refresh response without a scope keeps the permissions of the saved token
+		if tokenScope(fresh) == "" {
+			fresh = withScope(fresh, tokenScope(tok))
+		}
+		if err := a.tokens.Save(fresh); err != nil {
+			log.Printf("Warning: failed to save refreshed token: %v", err)
+		}
+	}
 
-	// Wait for auth to complete with timeout
-	select {
-	case spotifyClient := <-ch:
-		client.Client = spotifyClient
-	case <-time.After(5 * time.Minute):
-		return nil, fmt.Errorf("authentication timed out after 5 minutes")
+	// Settings enabled since the login may need permissions the token wasn't granted
+	if missing := missingScopes(tokenScope(fresh), a.oauth.Scopes); len(missing) > 0 {
+		return nil, fmt.Errorf("saved token lacks the permissions %s", strings.Join(missing, ", "))
 	}
 
 	return client, nil
 }
 
-// Cleanup properly shuts down the HTTP server
-func (c *Client) Cleanup() {
-	c.serverOnce.Do(func() {
-		if c.server != nil {
-			if err := c.server.Close(); err != nil {
-				log.Printf("Error closing server: %v", err)
-			}
-			c.serverWg.Wait()
+// missingScopes returns the required scopes that were not granted. Tokens saved
+// before their scope was recorded only ever had the playlist scopes.
+func missingScopes(granted string, required []string) []string {
+	have := make(map[string]bool)
+	for _, scope := range strings.Fields(granted) {
+		have[scope] = true
+	}
+	if granted == "" {
+		for _, scope := range baseScopes {
+			have[scope] = true
 		}
-	})
+	}
+
+	var missing []string
+	for _, scope := range required {
+		if !have[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
 }
 
-func (c *Client) completeAuth(w http.ResponseWriter, r *http.Request) {
-	tok, err := auth.Token(state, r)
-	if err != nil {
-		http.Error(w, "Couldn't get token", http.StatusForbidden)
-		log.Fatal(err)
+// baseScopes are the permissions every run needs: reading the user's playlists
+var baseScopes = []string{spotify.ScopePlaylistReadPrivate, spotify.ScopePlaylistReadCollaborative}
+
+// scopes returns the permissions to request: reading playlists, reading the library
+// if it is analyzed too, and reading the listening history for the listening report
+func scopes(cfg *config.Config) []string {
+	scopes := append([]string(nil), baseScopes...)
+	if cfg.IncludeLikedSongs || cfg.IncludeSavedAlbums {
+		scopes = append(scopes, spotify.ScopeUserLibraryRead)
 	}
-	if st := r.FormValue("state"); st != state {
-		http.NotFound(w, r)
-		log.Fatalf("State mismatch: %s != %s\n", st, state)
+	if cfg.ListeningReport {
+		scopes = append(scopes, spotify.ScopeUserTopRead, spotify.ScopeUserReadRecentlyPlayed)
+	}
+	return scopes
+}
+
+// newOAuthConfig builds the OAuth2 configuration for the configured authorization flow
+func newOAuthConfig(cfg *config.Config, scopes ...string) *oauth2.Config {
+	conf := &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURI,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   spotify.AuthURL,
+			TokenURL:  spotify.TokenURL,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}
+
+	if cfg.AccountsURL != "" {
+		accountsURL := strings.TrimSuffix(cfg.AccountsURL, "/")
+		conf.Endpoint.AuthURL = accountsURL + "/authorize"
+		conf.Endpoint.TokenURL = accountsURL + "/api/token"
 	}
 
-	// use the token to get an authenticated client
-	client := auth.NewClient(tok)
-	fmt.Fprintf(w, "Login Completed!")
-	ch <- &client
+	if cfg.AuthFlow == config.AuthFlowPKCE {
+		// PKCE clients send their client ID in the request body and never use the secret
+		conf.ClientSecret = ""
+		conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
+
+	return conf
+}
+
+// newSpotifyClient creates a Spotify client that refreshes the token as needed
+func (a *Authenticator) newSpotifyClient(tok *oauth2.Token) *spotify.Client {
+	client := spotify.NewClient(a.oauth.Client(a.ctx, tok))
+	return &client
+}
+
+// exchangeCode exchanges an authorization code for a token
+func (a *Authenticator) exchangeCode(code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return a.oauth.Exchange(a.ctx, code, opts...)
 }
 
-func openBrowser(url string) {
+// RetryStats returns the request and retry counts of the client so far
+func (c *Client) RetryStats() RetryStats {
+	if c.retry == nil {
+		return RetryStats{}
+	}
+	return c.retry.Stats()
+}
+
+// Cleanup saves the latest token, which may have been refreshed during the run
+func (c *Client) Cleanup() {
+	c.cleanupOnce.Do(func() {
+		if c.Client == nil || c.tokens == nil {
+			return
+		}
+		tok, err := c.Client.Token()
+		if err != nil {
+			log.Printf("Warning: failed to get current token: %v", err)
+			return
+		}
+		if err := c.tokens.Save(tok); err != nil {
+			log.Printf("Warning: failed to save token: %v", err)
+		}
+	})
+}
+
+// openBrowser opens the URL in the default browser
+func openBrowser(url string) error {
 	var err error
 	switch runtime.GOOS {
 	case "linux":
@@ -121,7 +385,5 @@ func openBrowser(url string) {
 	default:
 		err = fmt.Errorf("unsupported platform")
 	}
-	if err != nil {
-		log.Fatal(err)
-	}
+	return err
 }
@@ -0,0 +1,148 @@
+package spotify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/mikev/spotify-analysis/pkg/spotifytest"
+	"golang.org/x/oauth2"
+)
+
+func TestMissingScopes(t *testing.T) {
+	library := scopes(&config.Config{IncludeLikedSongs: true})
+	tests := []struct {
+		name     string
+		granted  string
+		required []string
+		missing  string
+	}{
+		{"all granted", "playlist-read-private playlist-read-collaborative user-library-read", library, ""},
+		{"library not granted", "playlist-read-private playlist-read-collaborative", library, "user-library-read"},
+		{"unrecorded scope covers the playlists", "", baseScopes, ""},
+		{"unrecorded scope lacks the library", "", library, "user-library-read"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(missingScopes(test.granted, test.required), " "); got != test.missing {
+			t.Errorf("%s: expected missing %q, got %q", test.name, test.missing, got)
+		}
+	}
+}
+
+func TestSavedTokenWithoutListeningScope(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+	// The account only granted the playlist permissions when it logged in
+	server.Scope = "playlist-read-private playlist-read-collaborative"
+
+	cfg := &config.Config{
+		ClientID:        "test-client",
+		ClientSecret:    "test-secret",
+		AuthFlow:        config.AuthFlowCode,
+		RedirectURI:     "http://localhost:8081/callback",
+		TokenFile:       filepath.Join(t.TempDir(), "token.json"),
+		APIURL:          server.URL,
+		AccountsURL:     server.URL,
+		ListeningReport: true,
+	}
+	a, err := NewAuthenticator(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token *oauth2.Token
+	}{
+		{"valid token", (&oauth2.Token{AccessToken: spotifytest.AccessToken, Expiry: time.Now().Add(time.Hour)}).
+			WithExtra(map[string]interface{}{"scope": server.Scope})},
+		// The refresh reports the scope of a token saved before scopes were recorded
+		{"refreshed token", &oauth2.Token{AccessToken: "expired", RefreshToken: spotifytest.RefreshToken, Expiry: time.Now().Add(-time.Hour)}},
+	}
+	for _, test := range tests {
+		if err := a.tokens.Save(test.token); err != nil {
+			t.Fatal(err)
+		}
+		// Without a client from the store, Login starts a new login
+		client, err := a.clientFromStore()
+		if client != nil || err == nil || !strings.Contains(err.Error(), "user-top-read") {
+			t.Errorf("%s: expected a new login for the missing scope, got client %v and error %v", test.name, client != nil, err)
+		}
+	}
+
+	// Once the scope is granted, the saved token is used
+	server.Scope = spotifytest.GrantedScope
+	if err := a.tokens.Save(&oauth2.Token{AccessToken: "expired", RefreshToken: spotifytest.RefreshToken, Expiry: time.Now().Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if client, err := a.clientFromStore(); client == nil || err != nil {
+		t.Errorf("expected the saved token to be used, got error %v", err)
+	}
+}
+
+func TestAuthenticatorHandler(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+
+	// Each authenticator serves its own callback with its own login state and results
+	first := newTestAuthenticator(t, server, config.AuthFlowCode)
+	second := newTestAuthenticator(t, server, config.AuthFlowCode)
+	firstHTTP := httptest.NewServer(first.Handler())
+	defer firstHTTP.Close()
+	secondHTTP := httptest.NewServer(second.Handler())
+	defer secondHTTP.Close()
+
+	states := make(map[*Authenticator]string)
+	for _, a := range []*Authenticator{first, second} {
+		authURL, err := a.beginLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[a] = mustParseURL(t, authURL).Query().Get("state")
+	}
+	if states[first] == states[second] {
+		t.Fatal("expected separate states per authenticator")
+	}
+
+	get := func(base string, values url.Values) int {
+		resp, err := http.Get(base + "/callback?" + values.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name   string
+		a      *Authenticator
+		base   string
+		state  string
+		status int
+	}{
+		// The state of another authenticator is a mismatch and uses up no attempt
+		{"other instance's state", first, firstHTTP.URL, states[second], http.StatusForbidden},
+		{"good callback", first, firstHTTP.URL, states[first], http.StatusOK},
+		// Completing the first login leaves the second one waiting for its own callback
+		{"second instance", second, secondHTTP.URL, states[second], http.StatusOK},
+	}
+	for _, test := range tests {
+		status := get(test.base, url.Values{"code": {"test-code"}, "state": {test.state}})
+		if status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+		res := pendingResult(test.a)
+		if test.status == http.StatusOK && (res == nil || res.err != nil || res.token.AccessToken != spotifytest.AccessToken) {
+			t.Errorf("%s: expected a token, got %+v", test.name, res)
+		}
+		if test.status != http.StatusOK && res != nil {
+			t.Errorf("%s: expected no login result, got %+v", test.name, res)
+		}
+	}
+}
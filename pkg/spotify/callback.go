@@ -0,0 +1,133 @@
+package spotify
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+// authResult is the outcome of a single login attempt
+type authResult struct {
+	token *oauth2.Token
+	err   error
+}
+
+// pageTemplate renders the page shown in the browser after a login attempt
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 4em auto; color: #222; }
+h1 { color: {{if .Failed}}#c0392b{{else}}#1db954{{end}}; }
+code { background: #f4f4f4; padding: 0.1em 0.3em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Detail}}<p>Details: <code>{{.Detail}}</code></p>{{end}}
+{{if .Failed}}<p><a href="/login">Try again</a></p>{{else}}<p>You can close this window and return to the terminal.</p>{{end}}
+</body>
+</html>
+`))
+
+// page holds the values rendered by pageTemplate
+type page struct {
+	Title   string
+	Message string
+	Detail  string
+	Failed  bool
+}
+
+// completeAuth handles the OAuth callback and reports the result to the waiting login.
+// Callbacks that don't belong to the current attempt, such as a reloaded or stray
+// request, are rejected without using up one of the login attempts.
+func (a *Authenticator) completeAuth(w http.ResponseWriter, r *http.Request) {
+	if !a.login.matches(r.URL.Query().Get("state")) {
+		log.Printf("Ignoring login callback for another login attempt")
+		renderPage(w, http.StatusForbidden, page{
+			Title:   "Login failed",
+			Message: "This response does not belong to the current login attempt (the link may have already been used).",
+			Failed:  true,
+		})
+		return
+	}
+
+	tok, err := a.tokenFromValues(r.URL.Query())
+	if err != nil {
+		log.Printf("Login attempt failed: %v", err)
+		renderPage(w, http.StatusForbidden, page{
+			Title:   "Login failed",
+			Message: "Spotify login could not be completed.",
+			Detail:  err.Error(),
+			Failed:  true,
+		})
+		a.sendResult(authResult{err: err})
+		return
+	}
+
+	renderPage(w, http.StatusOK, page{
+		Title:   "Login completed",
+		Message: "The Spotify playlist analysis is now running.",
+	})
+	a.sendResult(authResult{token: tok})
+}
+
+// startLogin starts a fresh login attempt and redirects the browser to Spotify
+func (a *Authenticator) startLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := a.beginLogin()
+	if err != nil {
+		renderPage(w, http.StatusInternalServerError, page{
+			Title:   "Login failed",
+			Message: "Could not start a new login attempt.",
+			Detail:  err.Error(),
+			Failed:  true,
+		})
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// tokenFromValues validates the callback parameters and exchanges the code for a token
+func (a *Authenticator) tokenFromValues(values url.Values) (*oauth2.Token, error) {
+	if e := values.Get("error"); e != "" {
+		return nil, fmt.Errorf("spotify: auth failed - %s", e)
+	}
+	code := values.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("spotify: didn't get access code")
+	}
+	opts, err := a.login.consume(values.Get("state"))
+	if err != nil {
+		return nil, err
+	}
+	tok, err := a.exchangeCode(code, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code for token: %v", err)
+	}
+	return tok, nil
+}
+
+// sendResult delivers a login result without blocking the HTTP handler
+func (a *Authenticator) sendResult(res authResult) {
+	select {
+	case a.results <- res:
+	default:
+		log.Println("Dropping login result: a previous result is still pending")
+	}
+}
+
+// renderPage writes an HTML page with the given status code
+func renderPage(w http.ResponseWriter, status int, p page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := pageTemplate.Execute(w, p); err != nil {
+		log.Printf("Error rendering page: %v", err)
+	}
+}
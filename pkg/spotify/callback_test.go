@@ -0,0 +1,148 @@
+package spotify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/mikev/spotify-analysis/pkg/spotifytest"
+)
+
+// newTestAuthenticator creates an authenticator whose token requests go to the fake server
+func newTestAuthenticator(t *testing.T, server *spotifytest.Server, flow string) *Authenticator {
+	t.Helper()
+	cfg := &config.Config{
+		ClientID:        "test-client",
+		ClientSecret:    "test-secret",
+		AuthFlow:        flow,
+		AuthMaxAttempts: 3,
+		RedirectURI:     "http://localhost:8081/callback",
+		Port:            8081,
+		TokenFile:       filepath.Join(t.TempDir(), "token.json"),
+		APIURL:          server.URL,
+		AccountsURL:     server.URL,
+	}
+	a, err := NewAuthenticator(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// callback sends a request to the login callback and returns the response
+func callback(a *Authenticator, values url.Values) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?"+values.Encode(), nil))
+	return rec
+}
+
+// pendingResult returns the login result delivered by the callback, if any
+func pendingResult(a *Authenticator) *authResult {
+	select {
+	case res := <-a.results:
+		return &res
+	default:
+		return nil
+	}
+}
+
+func TestCallbackIgnoresOtherAttempts(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+	a := newTestAuthenticator(t, server, config.AuthFlowCode)
+
+	authURL, err := a.beginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	state := u.Query().Get("state")
+
+	// Stray requests are rejected without using up a login attempt
+	for _, values := range []url.Values{
+		{},
+		{"code": {"stray-code"}, "state": {"another-state"}},
+		{"error": {"access_denied"}, "state": {"another-state"}},
+	} {
+		if rec := callback(a, values); rec.Code != http.StatusForbidden {
+			t.Errorf("%v: expected status 403, got %d", values, rec.Code)
+		}
+		if res := pendingResult(a); res != nil {
+			t.Errorf("%v: expected no login result, got %+v", values, res)
+		}
+	}
+
+	// The callback of the current attempt still completes the login
+	if rec := callback(a, url.Values{"code": {"test-code"}, "state": {state}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	res := pendingResult(a)
+	if res == nil || res.err != nil || res.token.AccessToken != spotifytest.AccessToken {
+		t.Fatalf("expected a token, got %+v", res)
+	}
+
+	// Replaying it is rejected the same way
+	if rec := callback(a, url.Values{"code": {"test-code"}, "state": {state}}); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a replay to be rejected, got %d", rec.Code)
+	}
+	if res := pendingResult(a); res != nil {
+		t.Errorf("expected no login result for a replay, got %+v", res)
+	}
+}
+
+func TestCallbackErrorPageAndRetry(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		values url.Values
+		detail string
+	}{
+		{"denied", url.Values{"error": {"access_denied"}}, "access_denied"},
+		{"no code", url.Values{}, "didn&#39;t get access code"},
+		{"failed exchange", url.Values{"code": {"rejected"}}, "failed to exchange code"},
+	}
+	for _, test := range tests {
+		a := newTestAuthenticator(t, server, config.AuthFlowCode)
+		if test.values.Get("code") == "rejected" {
+			server.Fail("/api/token", 1, http.StatusBadRequest)
+		}
+		authURL, err := a.beginLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := mustParseURL(t, authURL).Query().Get("state")
+		test.values.Set("state", state)
+
+		// A failed attempt shows the error page and reports the failure to the login
+		rec := callback(a, test.values)
+		body := rec.Body.String()
+		if rec.Code != http.StatusForbidden || !strings.Contains(body, "Login failed") || !strings.Contains(body, test.detail) || !strings.Contains(body, `href="/login"`) {
+			t.Errorf("%s: unexpected error page %d: %s", test.name, rec.Code, body)
+		}
+		if res := pendingResult(a); res == nil || res.err == nil {
+			t.Errorf("%s: expected a failed login result, got %+v", test.name, res)
+		}
+
+		// Try again redirects to Spotify with a fresh state
+		rec = httptest.NewRecorder()
+		a.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+		location := rec.Header().Get("Location")
+		retryState := mustParseURL(t, location).Query().Get("state")
+		if rec.Code != http.StatusFound || !strings.HasPrefix(location, server.URL+"/authorize?") || retryState == "" || retryState == state {
+			t.Fatalf("%s: expected a redirect to a new attempt, got %d %s", test.name, rec.Code, location)
+		}
+		if rec := callback(a, url.Values{"code": {"test-code"}, "state": {retryState}}); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Login completed") {
+			t.Errorf("%s: expected the retry to succeed, got %d: %s", test.name, rec.Code, rec.Body)
+		}
+		if res := pendingResult(a); res == nil || res.err != nil {
+			t.Errorf("%s: expected a token from the retry, got %+v", test.name, res)
+		}
+	}
+}
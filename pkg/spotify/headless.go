@@ -0,0 +1,90 @@
+package spotify
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// headlessLogin prints the authorization URL and reads the redirect URL (or bare
+// authorization code) pasted by the user, then exchanges it for a token.
+// Each failed attempt starts a new login with a fresh state.
+func (a *Authenticator) headlessLogin(in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	scanner := bufio.NewScanner(in)
+	var lastErr error
+
+	for attempt := 1; attempt <= a.cfg.AuthMaxAttempts; attempt++ {
+		authURL, err := a.beginLogin()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintln(out, "Please log in to Spotify by visiting the following page in any browser:")
+		fmt.Fprintln(out, authURL)
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "After approving access your browser is redirected to a page that may fail to load.")
+		fmt.Fprint(out, "Paste the full URL from the address bar (or just the code): ")
+
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("failed to read input: %v", err)
+			}
+			return nil, fmt.Errorf("no authorization response received")
+		}
+
+		tok, err := a.tokenFromPaste(scanner.Text())
+		if err == nil {
+			return tok, nil
+		}
+		lastErr = err
+		fmt.Fprintf(out, "Login attempt %d/%d failed: %v\n\n", attempt, a.cfg.AuthMaxAttempts, err)
+	}
+
+	return nil, fmt.Errorf("login failed after %d attempts: %v", a.cfg.AuthMaxAttempts, lastErr)
+}
+
+// headlessLoginContext runs headlessLogin until it finishes or the authenticator's
+// context is cancelled. Reading stdin cannot be interrupted, so on cancellation
+// the read is abandoned.
+func (a *Authenticator) headlessLoginContext(in io.Reader, out io.Writer) (*oauth2.Token, error) {
+	done := make(chan authResult, 1)
+	go func() {
+		tok, err := a.headlessLogin(in, out)
+		done <- authResult{token: tok, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.token, res.err
+	case <-a.ctx.Done():
+		return nil, fmt.Errorf("login cancelled: %v", a.ctx.Err())
+	}
+}
+
+// tokenFromPaste exchanges a pasted redirect URL or bare authorization code for a token.
+// The state of a redirect URL is validated like a browser callback; a bare code
+// carries no state, so the current attempt's state is used.
+func (a *Authenticator) tokenFromPaste(input string) (*oauth2.Token, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return nil, fmt.Errorf("empty input")
+	}
+
+	if !strings.ContainsAny(input, "?=&") {
+		return a.tokenFromValues(url.Values{"code": {input}, "state": {a.login.current()}})
+	}
+
+	query := input
+	if i := strings.Index(input, "?"); i >= 0 {
+		query = input[i+1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse redirect URL: %v", err)
+	}
+	return a.tokenFromValues(values)
+}
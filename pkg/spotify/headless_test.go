@@ -0,0 +1,87 @@
+package spotify
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/mikev/spotify-analysis/pkg/spotifytest"
+)
+
+func TestTokenFromPaste(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+	a := newTestAuthenticator(t, server, config.AuthFlowPKCE)
+
+	// %s is replaced with the state of the attempt
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"redirect URL", "http://localhost:8081/callback?code=test-code&state=%s", ""},
+		{"redirect URL with spaces", "  http://localhost:8081/callback?code=test-code&state=%s\n", ""},
+		{"query only", "code=test-code&state=%s", ""},
+		{"bare code", "test-code", ""},
+		{"empty", "   ", "empty input"},
+		{"denied", "http://localhost:8081/callback?error=access_denied&state=%s", "access_denied"},
+		{"no code", "http://localhost:8081/callback?state=%s", "didn't get access code"},
+		{"other attempt", "http://localhost:8081/callback?code=test-code&state=other", "state mismatch"},
+		{"malformed query", "http://localhost:8081/callback?code=%zz", "could not parse"},
+	}
+	for _, test := range tests {
+		authURL, err := a.beginLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := mustParseURL(t, authURL).Query().Get("state")
+		input := test.input
+		if strings.Contains(input, "state=%s") {
+			input = strings.Replace(input, "%s", url.QueryEscape(state), 1)
+		}
+
+		tok, err := a.tokenFromPaste(input)
+		if test.err == "" {
+			if err != nil || tok.AccessToken != spotifytest.AccessToken {
+				t.Errorf("%s: expected a token, got %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestHeadlessLogin(t *testing.T) {
+	server := spotifytest.NewServer(&spotifytest.Fixture{})
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		input string
+		err   string
+		// urls is the number of authorization URLs printed
+		urls int
+	}{
+		{"first attempt", "test-code\n", "", 1},
+		{"retry after a failure", "\nhttp://localhost:8081/callback?error=access_denied\ntest-code\n", "", 3},
+		{"too many failures", "\n\n\ntest-code\n", "login failed after 3 attempts", 3},
+		{"no input", "", "no authorization response", 1},
+	}
+	for _, test := range tests {
+		a := newTestAuthenticator(t, server, config.AuthFlowCode)
+		var out bytes.Buffer
+		tok, err := a.headlessLogin(strings.NewReader(test.input), &out)
+		if test.err == "" {
+			if err != nil || tok.AccessToken != spotifytest.AccessToken {
+				t.Errorf("%s: expected a token, got %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if urls := strings.Count(out.String(), server.URL+"/authorize?"); urls != test.urls {
+			t.Errorf("%s: expected %d authorization URLs, got %d:\n%s", test.name, test.urls, urls, out.String())
+		}
+	}
+}
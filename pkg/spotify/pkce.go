@@ -0,0 +1,16 @@
+package spotify
+
+import "golang.org/x/oauth2"
+
+// pkceChallenge returns the authorization URL parameters for a PKCE login.
+// Only the SHA-256 challenge of the verifier is sent with the authorization
+// request; the verifier itself is sent with the token exchange so Spotify can
+// check that both requests came from the same client without a client secret.
+func pkceChallenge(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+}
+
+// pkceVerifier returns the token exchange parameters for a PKCE login
+func pkceVerifier(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{oauth2.VerifierOption(verifier)}
+}
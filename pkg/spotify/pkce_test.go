@@ -0,0 +1,95 @@
+package spotify
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+	"github.com/mikev/spotify-analysis/pkg/spotifytest"
+)
+
+// tokenRequest is what the fake token endpoint received
+type tokenRequest struct {
+	form      url.Values
+	basicAuth bool
+}
+
+// fakeTokenEndpoint serves a token endpoint that records the last request
+func fakeTokenEndpoint(t *testing.T) (*httptest.Server, *tokenRequest) {
+	t.Helper()
+	var got tokenRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/token" || r.ParseForm() != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		_, _, got.basicAuth = r.BasicAuth()
+		got.form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"` + spotifytest.AccessToken + `","token_type":"Bearer","expires_in":3600,"scope":"` + spotifytest.GrantedScope + `"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &got
+}
+
+func TestPKCEFlow(t *testing.T) {
+	tests := []struct {
+		flow string
+		pkce bool
+	}{
+		{config.AuthFlowCode, false},
+		{config.AuthFlowPKCE, true},
+	}
+	for _, test := range tests {
+		t.Run(test.flow, func(t *testing.T) {
+			server, got := fakeTokenEndpoint(t)
+			a := newTestAuthenticator(t, &spotifytest.Server{Server: server}, test.flow)
+
+			authURL, err := a.beginLogin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := mustParseURL(t, authURL).Query()
+			challenge := query.Get("code_challenge")
+			if (challenge != "") != test.pkce || (query.Get("code_challenge_method") == "S256") != test.pkce {
+				t.Fatalf("unexpected challenge parameters in %s", authURL)
+			}
+			if query.Get("code_verifier") != "" {
+				t.Fatalf("the verifier must never be sent with the authorization request: %s", authURL)
+			}
+
+			rec := callback(a, url.Values{"code": {"test-code"}, "state": {query.Get("state")}})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+			}
+
+			// The exchange proves possession of the verifier instead of sending the secret
+			verifier := got.form.Get("code_verifier")
+			sum := sha256.Sum256([]byte(verifier))
+			if test.pkce {
+				if verifier == "" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+					t.Errorf("verifier %q does not match challenge %q", verifier, challenge)
+				}
+				if got.basicAuth || got.form.Get("client_secret") != "" || got.form.Get("client_id") != "test-client" {
+					t.Errorf("expected only the client ID in the exchange, got %v (basic auth %v)", got.form, got.basicAuth)
+				}
+			} else if verifier != "" || !got.basicAuth {
+				t.Errorf("expected the client secret and no verifier, got %v (basic auth %v)", got.form, got.basicAuth)
+			}
+		})
+	}
+}
+
+// mustParseURL parses a URL or fails the test
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -1,62 +1,140 @@
 package spotify
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
 )
 
-// checkAndCleanupPort checks if the port is in use and attempts to kill any processes using it
-func checkAndCleanupPort(port int) error {
-	// Get process ID using the port
-	pid, err := getProcessUsingPort(port)
-	if err != nil {
-		return fmt.Errorf("failed to check port usage: %v", err)
+// portOwner describes the process listening on a port
+type portOwner struct {
+	PID     int
+	Command string
+}
+
+func (o portOwner) String() string {
+	if o.Command == "" {
+		return fmt.Sprintf("PID %d", o.PID)
 	}
+	return fmt.Sprintf("%s (PID %d)", o.Command, o.PID)
+}
 
-	// If no process is using the port, return
-	if pid == 0 {
-		return nil
+// listenCallback binds the listener for the OAuth callback. If the configured port
+// is taken it either terminates the owner (only with SPOTIFY_KILL_PORT_OWNER=true),
+// falls back to a free port from SPOTIFY_PORT_RANGE, or fails naming the process.
+// It returns the listener and the port it is bound to.
+func listenCallback(cfg *config.Config) (net.Listener, int, error) {
+	listener, err := listen(cfg.Port)
+	if err == nil {
+		return listener, cfg.Port, nil
+	}
+	if !isAddrInUse(err) {
+		return nil, 0, fmt.Errorf("failed to listen on port %d: %v", cfg.Port, err)
+	}
+
+	owner, lookupErr := getProcessUsingPort(cfg.Port)
+	if lookupErr != nil {
+		log.Printf("Warning: could not determine which process uses port %d: %v", cfg.Port, lookupErr)
+	}
+
+	// Terminating the owner is strictly opt-in
+	if cfg.KillPortOwner && owner != nil {
+		log.Printf("Port %d is in use by %s. Terminating it because SPOTIFY_KILL_PORT_OWNER=true...", cfg.Port, owner)
+		if err := killProcess(owner.PID); err != nil {
+			return nil, 0, fmt.Errorf("failed to kill process %d: %v", owner.PID, err)
+		}
+		// Give the OS a moment to release the port
+		time.Sleep(500 * time.Millisecond)
+		listener, err := listen(cfg.Port)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to listen on port %d after terminating %s: %v", cfg.Port, owner, err)
+		}
+		log.Printf("Successfully terminated process using port %d", cfg.Port)
+		return listener, cfg.Port, nil
+	}
+
+	// Try the alternate ports, which only works if the redirect URI may follow
+	if cfg.AllowRedirectPortChange && cfg.PortRangeStart > 0 {
+		for port := cfg.PortRangeStart; port <= cfg.PortRangeEnd; port++ {
+			if port == cfg.Port {
+				continue
+			}
+			listener, err := listen(port)
+			if err == nil {
+				log.Printf("Port %d is in use, using alternate port %d", cfg.Port, port)
+				return listener, port, nil
+			}
+		}
+		return nil, 0, fmt.Errorf("port %d is in use by %s and no alternate port in %d-%d is free",
+			cfg.Port, describeOwner(owner), cfg.PortRangeStart, cfg.PortRangeEnd)
 	}
 
-	log.Printf("Found process (PID: %d) using port %d. Attempting to terminate...", pid, port)
+	return nil, 0, fmt.Errorf("port %d is already in use by %s; stop that process, change SPOTIFY_PORT, "+
+		"set SPOTIFY_PORT_RANGE with SPOTIFY_ALLOW_REDIRECT_PORT_CHANGE=true, or set SPOTIFY_KILL_PORT_OWNER=true to terminate it",
+		cfg.Port, describeOwner(owner))
+}
+
+// listen binds a TCP listener on the given port
+func listen(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
 
-	// Kill the process
-	if err := killProcess(pid); err != nil {
-		return fmt.Errorf("failed to kill process %d: %v", pid, err)
+// isAddrInUse reports whether a listen error was caused by the port already being bound
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || strings.Contains(err.Error(), "address already in use")
+}
+
+// describeOwner formats a possibly unknown port owner for error messages
+func describeOwner(owner *portOwner) string {
+	if owner == nil {
+		return "another process"
 	}
+	return owner.String()
+}
 
-	log.Printf("Successfully terminated process using port %d", port)
-	return nil
+// redirectURIWithPort returns the redirect URI with its port replaced
+func redirectURIWithPort(redirectURI string, port int) (string, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect URI %s: %v", redirectURI, err)
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	return u.String(), nil
 }
 
-// getProcessUsingPort returns the PID of the process using the specified port
-func getProcessUsingPort(port int) (int, error) {
+// getProcessUsingPort returns the process listening on the specified port, or nil if none was found
+func getProcessUsingPort(port int) (*portOwner, error) {
 	var cmd *exec.Cmd
 
 	switch runtime.GOOS {
 	case "darwin", "linux":
 		// For macOS and Linux, use lsof
-		cmd = exec.Command("lsof", "-i", fmt.Sprintf(":%d", port))
+		cmd = exec.Command("lsof", "-nP", fmt.Sprintf("-iTCP:%d", port), "-sTCP:LISTEN")
 	case "windows":
-		// For Windows, use netstat
-		cmd = exec.Command("netstat", "-ano", "|", "findstr", fmt.Sprintf(":%d", port))
+		// For Windows, use netstat and filter the output ourselves
+		cmd = exec.Command("netstat", "-ano", "-p", "TCP")
 	default:
-		return 0, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return nil, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		// If the command returns an error, it likely means no process is using the port
-		return 0, nil
+		return nil, nil
 	}
 
-	// Parse the output to find the PID
-	pid := parseProcessID(string(output), runtime.GOOS)
-	return pid, nil
+	// Parse the output to find the process
+	return parseProcess(string(output), runtime.GOOS, port), nil
 }
 
 // killProcess terminates a process by its PID
@@ -75,8 +153,8 @@ func killProcess(pid int) error {
 	return cmd.Run()
 }
 
-// parseProcessID extracts the process ID from the command output
-func parseProcessID(output, os string) int {
+// parseProcess extracts the process listening on port from the command output
+func parseProcess(output, os string, port int) *portOwner {
 	switch os {
 	case "darwin", "linux":
 		// Example output format:
@@ -84,39 +162,55 @@ func parseProcessID(output, os string) int {
 		// main    12345    user    8u  IPv6  0x123456789abcdef      0t0  TCP *:8081 (LISTEN)
 		lines := strings.Split(output, "\n")
 		if len(lines) < 2 {
-			return 0
+			return nil
 		}
 		fields := strings.Fields(lines[1])
 		if len(fields) < 3 {
-			return 0
+			return nil
 		}
 		pid, err := strconv.Atoi(fields[1])
 		if err != nil {
-			return 0
+			return nil
 		}
-		return pid
+		return &portOwner{PID: pid, Command: fields[0]}
 
 	case "windows":
 		// Example output format:
 		// Proto  Local Address          Foreign Address        State           PID
 		// TCP    0.0.0.0:8081          0.0.0.0:0              LISTENING       12345
+		suffix := fmt.Sprintf(":%d", port)
 		lines := strings.Split(output, "\n")
 		for _, line := range lines {
 			if strings.Contains(line, "LISTENING") {
 				fields := strings.Fields(line)
-				if len(fields) < 5 {
+				if len(fields) < 5 || !strings.HasSuffix(fields[1], suffix) {
 					continue
 				}
 				pid, err := strconv.Atoi(fields[4])
 				if err != nil {
 					continue
 				}
-				return pid
+				return &portOwner{PID: pid, Command: windowsProcessName(pid)}
 			}
 		}
-		return 0
+		return nil
 
 	default:
-		return 0
+		return nil
+	}
+}
+
+// windowsProcessName looks up the image name of a process on Windows
+func windowsProcessName(pid int) string {
+	output, err := exec.Command("tasklist", "/FI", fmt.Sprintf("PID eq %d", pid), "/FO", "CSV", "/NH").Output()
+	if err != nil {
+		return ""
+	}
+	// Example output format:
+	// "node.exe","12345","Console","1","45,123 K"
+	fields := strings.Split(strings.TrimSpace(string(output)), ",")
+	if len(fields) < 2 {
+		return ""
 	}
+	return strings.Trim(fields[0], "\"")
 }
@@ -0,0 +1,96 @@
+package spotify
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/config"
+)
+
+// freePort returns a port that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenCallback(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+	free := freePort(t)
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		port int
+		err  string
+	}{
+		{"free port", config.Config{Port: free}, free, ""},
+		{"taken port", config.Config{Port: takenPort}, 0, "already in use"},
+		{"range without redirect change", config.Config{Port: takenPort, PortRangeStart: free, PortRangeEnd: free}, 0, "already in use"},
+		{"fallback port", config.Config{Port: takenPort, PortRangeStart: free, PortRangeEnd: free, AllowRedirectPortChange: true}, free, ""},
+		{"range exhausted", config.Config{Port: takenPort, PortRangeStart: takenPort, PortRangeEnd: takenPort, AllowRedirectPortChange: true}, 0, "no alternate port"},
+	}
+	for _, test := range tests {
+		listener, port, err := listenCallback(&test.cfg)
+		if test.err == "" {
+			if err != nil || port != test.port {
+				t.Errorf("%s: expected port %d, got %d, %v", test.name, test.port, port, err)
+			}
+			if listener != nil {
+				listener.Close()
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestRedirectURIWithPort(t *testing.T) {
+	tests := []struct {
+		uri  string
+		port int
+		want string
+	}{
+		{"http://localhost:8081/callback", 8090, "http://localhost:8090/callback"},
+		{"http://127.0.0.1:8081/callback?x=1", 8082, "http://127.0.0.1:8082/callback?x=1"},
+		{"http://localhost/callback", 8083, "http://localhost:8083/callback"},
+		{"http://[::1]:8081/callback", 8084, "http://[::1]:8084/callback"},
+	}
+	for _, test := range tests {
+		got, err := redirectURIWithPort(test.uri, test.port)
+		if err != nil || got != test.want {
+			t.Errorf("%s with port %d: expected %s, got %s (%v)", test.uri, test.port, test.want, got, err)
+		}
+	}
+	if _, err := redirectURIWithPort("http://local host:%zz", 8081); err == nil {
+		t.Error("expected an invalid redirect URI to fail")
+	}
+}
+
+func TestParseProcess(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		os     string
+		want   *portOwner
+	}{
+		{"lsof", "COMMAND  PID  USER  FD  TYPE  DEVICE SIZE/OFF NODE NAME\nmain    12345 user 8u IPv6 0x1 0t0 TCP *:8081 (LISTEN)\n", "linux", &portOwner{PID: 12345, Command: "main"}},
+		{"lsof without process", "", "darwin", nil},
+	}
+	for _, test := range tests {
+		got := parseProcess(test.output, test.os, 8081)
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package spotify
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitTransport spaces out requests so that all callers sharing it, such as
+// concurrent playlist workers, stay under a fixed number of requests per second
+type rateLimitTransport struct {
+	base     http.RoundTripper
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newRateLimitTransport creates a transport allowing perSecond requests per second
+func newRateLimitTransport(base http.RoundTripper, perSecond float64) *rateLimitTransport {
+	return &rateLimitTransport{
+		base:     base,
+		interval: time.Duration(float64(time.Second) / perSecond),
+	}
+}
+
+// RoundTrip waits for the request's turn and then sends it
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := sleepContext(req, t.reserve()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// reserve claims the next free request slot and returns how long to wait for it
+func (t *rateLimitTransport) reserve() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	wait := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	return wait
+}
@@ -0,0 +1,24 @@
+package spotify
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransportReserve(t *testing.T) {
+	transport := newRateLimitTransport(nil, 10)
+
+	// Consecutive requests are spaced 100ms apart
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		waits = append(waits, transport.reserve())
+	}
+	if waits[0] != 0 {
+		t.Errorf("expected the first request to go immediately, waited %s", waits[0])
+	}
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if got := waits[i+1]; got < want-10*time.Millisecond || got > want {
+			t.Errorf("request %d: expected a wait of about %s, got %s", i+2, want, got)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package spotify
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryStats counts the API requests made during a run and how many had to be retried
+type RetryStats struct {
+	Requests      int
+	Retries       int
+	RateLimited   int
+	ServerErrors  int
+	NetworkErrors int
+	Failures      int
+	Waited        time.Duration
+}
+
+// retryTransport retries Web API reads that fail with 429 Too Many Requests, a
+// 5xx status or a network error. Rate limited requests wait for the Retry-After
+// period; other failures back off exponentially with jitter.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	sleep      func(*http.Request, time.Duration) error
+
+	mu    sync.Mutex
+	stats RetryStats
+}
+
+// newRetryTransport creates a retry transport wrapping base
+func newRetryTransport(base http.RoundTripper, maxRetries int, baseDelay, maxDelay time.Duration) *retryTransport {
+	return &retryTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+		sleep:      sleepContext,
+	}
+}
+
+// RoundTrip sends the request, retrying transient failures of GET requests
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only reads are safe to repeat; token requests and writes are sent once
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		t.record(func(s *RetryStats) { s.Requests++ })
+		resp, err := t.base.RoundTrip(req)
+
+		var reason string
+		var delay time.Duration
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			t.record(func(s *RetryStats) { s.NetworkErrors++ })
+			reason = err.Error()
+			delay = t.backoff(attempt)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			t.record(func(s *RetryStats) { s.RateLimited++ })
+			reason = resp.Status
+			var ok bool
+			if delay, ok = retryAfter(resp); !ok {
+				delay = t.backoff(attempt)
+			}
+		case resp.StatusCode >= 500:
+			t.record(func(s *RetryStats) { s.ServerErrors++ })
+			reason = resp.Status
+			delay = t.backoff(attempt)
+		default:
+			return resp, nil
+		}
+
+		// Give up when out of retries or when the server asks for a longer wait than allowed
+		if attempt >= t.maxRetries || delay > t.maxDelay {
+			t.record(func(s *RetryStats) { s.Failures++ })
+			if delay > t.maxDelay {
+				log.Printf("Not retrying %s: Retry-After of %s exceeds the maximum retry delay of %s", req.URL.Path, delay, t.maxDelay)
+			} else if t.maxRetries > 0 {
+				log.Printf("Giving up on %s after %d retries: %s", req.URL.Path, attempt, reason)
+			}
+			return resp, err
+		}
+
+		// Drain the failed response so the connection can be reused
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		log.Printf("Request to %s failed (%s), retry %d/%d in %s", req.URL.Path, reason, attempt+1, t.maxRetries, delay.Round(time.Millisecond))
+		t.record(func(s *RetryStats) {
+			s.Retries++
+			s.Waited += delay
+		})
+		if err := t.sleep(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Stats returns a copy of the statistics collected so far
+func (t *retryTransport) Stats() RetryStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// record updates the statistics under the lock
+func (t *retryTransport) record(update func(*RetryStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	update(&t.stats)
+}
+
+// backoff returns the exponential backoff delay for an attempt, with full jitter
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.maxDelay
+	if attempt < 30 && t.baseDelay<<uint(attempt) < t.maxDelay {
+		delay = t.baseDelay << uint(attempt)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Spread retries from concurrent requests so they don't all hit the API at once
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sleepContext waits for the delay or until the request is cancelled
+func sleepContext(req *http.Request, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return fmt.Errorf("retry cancelled: %v", req.Context().Err())
+	}
+}
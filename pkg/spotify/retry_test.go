@@ -0,0 +1,114 @@
+package spotify
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// scripted returns a transport answering with the given statuses in order; a
+// zero status produces a network error
+func scripted(statuses ...int) (http.RoundTripper, *int) {
+	calls := 0
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		status := statuses[calls]
+		calls++
+		if status == 0 {
+			return nil, errors.New("connection reset")
+		}
+		resp := &http.Response{StatusCode: status, Status: http.StatusText(status), Header: make(http.Header), Body: io.NopCloser(strings.NewReader("{}"))}
+		if status == http.StatusTooManyRequests {
+			resp.Header.Set("Retry-After", "7")
+		}
+		return resp, nil
+	}), &calls
+}
+
+// newTestRetryTransport creates a retry transport that records its waits instead of sleeping
+func newTestRetryTransport(base http.RoundTripper, maxRetries int) (*retryTransport, *[]time.Duration) {
+	var waits []time.Duration
+	t := newRetryTransport(base, maxRetries, 100*time.Millisecond, 10*time.Second)
+	t.sleep = func(req *http.Request, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	return t, &waits
+}
+
+func TestRetryTransport(t *testing.T) {
+	base, calls := scripted(http.StatusTooManyRequests, http.StatusBadGateway, 0, http.StatusOK)
+	transport, waits := newTestRetryTransport(base, 5)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.spotify.com/v1/me", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected success, got %v %v", resp, err)
+	}
+	if *calls != 4 {
+		t.Errorf("expected 4 calls, got %d", *calls)
+	}
+
+	// The rate limited request waits exactly Retry-After; the others back off with jitter
+	if (*waits)[0] != 7*time.Second {
+		t.Errorf("expected Retry-After wait of 7s, got %s", (*waits)[0])
+	}
+	if w := (*waits)[1]; w < 100*time.Millisecond || w > 200*time.Millisecond {
+		t.Errorf("unexpected backoff for retry 2: %s", w)
+	}
+	if w := (*waits)[2]; w < 200*time.Millisecond || w > 400*time.Millisecond {
+		t.Errorf("unexpected backoff for retry 3: %s", w)
+	}
+
+	stats := transport.Stats()
+	want := RetryStats{Requests: 4, Retries: 3, RateLimited: 1, ServerErrors: 1, NetworkErrors: 1}
+	stats.Waited = 0
+	if stats != want {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	base, calls := scripted(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	transport, _ := newTestRetryTransport(base, 2)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.spotify.com/v1/me", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the final 503 to be returned, got %v %v", resp, err)
+	}
+	if *calls != 3 || transport.Stats().Failures != 1 {
+		t.Errorf("expected 3 calls and 1 failure, got %d calls and %+v", *calls, transport.Stats())
+	}
+}
+
+func TestRetryTransportSkipsLongRetryAfter(t *testing.T) {
+	base, calls := scripted(http.StatusTooManyRequests)
+	transport, _ := newTestRetryTransport(base, 5)
+	transport.maxDelay = time.Second
+
+	req, _ := http.NewRequest(http.MethodGet, "https://api.spotify.com/v1/me", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || *calls != 1 {
+		t.Fatalf("expected a single 429, got %v %v after %d calls", resp, err, *calls)
+	}
+}
+
+func TestRetryTransportOnlyRetriesGet(t *testing.T) {
+	base, calls := scripted(http.StatusServiceUnavailable)
+	transport, _ := newTestRetryTransport(base, 5)
+
+	req, _ := http.NewRequest(http.MethodPost, "https://accounts.spotify.com/api/token", nil)
+	if resp, err := transport.RoundTrip(req); err != nil || resp.StatusCode != http.StatusServiceUnavailable || *calls != 1 {
+		t.Fatalf("expected POST to be sent once, got %v %v after %d calls", resp, err, *calls)
+	}
+}
@@ -0,0 +1,84 @@
+package spotify
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// loginState tracks the OAuth state and PKCE verifier of the current login attempt.
+// Every attempt gets a fresh random state, and a state can only be used once.
+type loginState struct {
+	mu       sync.Mutex
+	state    string
+	verifier string
+}
+
+// begin starts a new login attempt and returns its authorization URL
+func (l *loginState) begin(conf *oauth2.Config, pkce bool, opts ...oauth2.AuthCodeOption) (string, error) {
+	st, err := randomState()
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.state = st
+	l.verifier = ""
+
+	if pkce {
+		l.verifier = oauth2.GenerateVerifier()
+		opts = append(opts, pkceChallenge(l.verifier)...)
+	}
+	return conf.AuthCodeURL(st, opts...), nil
+}
+
+// current returns the state of the login attempt in progress
+func (l *loginState) current() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// matches reports whether a state returned by Spotify belongs to the login attempt
+// in progress, without invalidating it
+func (l *loginState) matches(st string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state != "" && subtle.ConstantTimeCompare([]byte(st), []byte(l.state)) == 1
+}
+
+// consume validates a state returned by Spotify and invalidates it so it can't be replayed.
+// It returns the token exchange options for the login attempt.
+func (l *loginState) consume(st string) ([]oauth2.AuthCodeOption, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.state == "" {
+		return nil, fmt.Errorf("no login in progress (the link may have already been used)")
+	}
+	if subtle.ConstantTimeCompare([]byte(st), []byte(l.state)) != 1 {
+		return nil, fmt.Errorf("state mismatch: the response does not belong to the current login attempt")
+	}
+	l.state = ""
+
+	var opts []oauth2.AuthCodeOption
+	if l.verifier != "" {
+		opts = append(opts, pkceVerifier(l.verifier)...)
+	}
+	return opts, nil
+}
+
+// randomState returns a cryptographically random, URL-safe state value
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate state: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
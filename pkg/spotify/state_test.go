@@ -0,0 +1,55 @@
+package spotify
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestLoginState(t *testing.T) {
+	conf := &oauth2.Config{ClientID: "test-client", Endpoint: oauth2.Endpoint{AuthURL: "https://accounts.example.com/authorize"}}
+	var login loginState
+
+	if _, err := login.consume("anything"); err == nil || !strings.Contains(err.Error(), "no login in progress") {
+		t.Errorf("expected no login in progress, got %v", err)
+	}
+
+	first, err := login.begin(conf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstState := mustParseURL(t, first).Query().Get("state")
+	second, err := login.begin(conf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondState := mustParseURL(t, second).Query().Get("state")
+	if firstState == "" || firstState == secondState {
+		t.Fatalf("expected a fresh state per attempt, got %q and %q", firstState, secondState)
+	}
+
+	tests := []struct {
+		name  string
+		state string
+		err   string
+	}{
+		{"superseded attempt", firstState, "state mismatch"},
+		{"missing state", "", "state mismatch"},
+		{"current attempt", secondState, ""},
+		{"replay", secondState, "already been used"},
+	}
+	for _, test := range tests {
+		if matched := login.matches(test.state); matched != (test.err == "") {
+			t.Errorf("%s: expected matches to be %v", test.name, test.err == "")
+		}
+		opts, err := login.consume(test.state)
+		if test.err == "" {
+			if err != nil || len(opts) != 1 {
+				t.Errorf("%s: expected the verifier option, got %v, %v", test.name, opts, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
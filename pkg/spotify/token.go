@@ -0,0 +1,203 @@
+package spotify
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mikev/spotify-analysis/pkg/atomicfile"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+)
+
+// Parameters of the scrypt key derivation. New token files use the cost recommended
+// for interactive logins; each file records the parameters it was encrypted with, so
+// they can be raised without breaking saved tokens. The maximums bound the cost a
+// tampered file can demand.
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptMaxN   = 1 << 20
+	scryptMaxR   = 32
+	scryptMaxP   = 16
+	saltSize     = 16
+	keySize      = 32
+	kdfAlgorithm = "scrypt"
+)
+
+// TokenStore persists OAuth tokens to disk so that a login survives between runs
+type TokenStore struct {
+	path       string
+	passphrase string
+}
+
+// storedToken is the on-disk representation of a token. When the store has an
+// encryption key the token is kept in Data as AES-GCM ciphertext instead of Token.
+// Scope lists the permissions granted with the token, which oauth2.Token doesn't
+// persist itself.
+type storedToken struct {
+	Encrypted bool          `json:"encrypted"`
+	Scope     string        `json:"scope,omitempty"`
+	Token     *oauth2.Token `json:"token,omitempty"`
+	KDF       *kdfParams    `json:"kdf,omitempty"`
+	Nonce     []byte        `json:"nonce,omitempty"`
+	Data      []byte        `json:"data,omitempty"`
+}
+
+// kdfParams describes how the encryption key of a token file is derived from the
+// passphrase
+type kdfParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// NewTokenStore creates a file-backed token store. If passphrase is not empty,
+// tokens are encrypted with a key derived from it with scrypt and a random salt.
+func NewTokenStore(path, passphrase string) *TokenStore {
+	return &TokenStore{path: path, passphrase: passphrase}
+}
+
+// Load reads the token from disk. It returns a nil token and no error if no token has been saved yet.
+func (s *TokenStore) Load() (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	var stored storedToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %v", err)
+	}
+
+	if !stored.Encrypted {
+		return withScope(stored.Token, stored.Scope), nil
+	}
+
+	if s.passphrase == "" {
+		return nil, fmt.Errorf("token file %s is encrypted but no SPOTIFY_TOKEN_KEY is set", s.path)
+	}
+
+	key, err := s.deriveKey(stored.KDF)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, stored.Nonce, stored.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file (wrong key?): %v", err)
+	}
+
+	var tok oauth2.Token
+	if err := json.Unmarshal(plaintext, &tok); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted token: %v", err)
+	}
+	return withScope(&tok, stored.Scope), nil
+}
+
+// Save writes the token to disk, readable only by the current user
+func (s *TokenStore) Save(tok *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create token directory: %v", err)
+	}
+
+	stored := storedToken{Token: tok, Scope: tokenScope(tok)}
+	if s.passphrase != "" {
+		plaintext, err := json.Marshal(tok)
+		if err != nil {
+			return fmt.Errorf("failed to encode token: %v", err)
+		}
+		// Every save uses a new salt, so equal passphrases never share a key
+		kdf := &kdfParams{Algorithm: kdfAlgorithm, Salt: make([]byte, saltSize), N: scryptN, R: scryptR, P: scryptP}
+		if _, err := io.ReadFull(rand.Reader, kdf.Salt); err != nil {
+			return fmt.Errorf("failed to generate salt: %v", err)
+		}
+		key, err := s.deriveKey(kdf)
+		if err != nil {
+			return err
+		}
+		gcm, err := newCipher(key)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return fmt.Errorf("failed to generate nonce: %v", err)
+		}
+		stored = storedToken{
+			Encrypted: true,
+			Scope:     stored.Scope,
+			KDF:       kdf,
+			Nonce:     nonce,
+			Data:      gcm.Seal(nil, nonce, plaintext, nil),
+		}
+	}
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode token file: %v", err)
+	}
+
+	if err := atomicfile.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save token file: %v", err)
+	}
+	return nil
+}
+
+// tokenScope returns the permissions granted with a token, as reported by Spotify in
+// the scope field of the token response, or an empty string if unknown
+func tokenScope(tok *oauth2.Token) string {
+	scope, _ := tok.Extra("scope").(string)
+	return scope
+}
+
+// withScope attaches the saved scope to a loaded token, so it can be read with tokenScope
+func withScope(tok *oauth2.Token, scope string) *oauth2.Token {
+	if tok == nil || scope == "" {
+		return tok
+	}
+	return tok.WithExtra(map[string]interface{}{"scope": scope})
+}
+
+// deriveKey derives the encryption key of a token file from the passphrase. The
+// parameters come from the file, so their cost is bounded before deriving the key.
+func (s *TokenStore) deriveKey(kdf *kdfParams) ([]byte, error) {
+	if kdf == nil {
+		return nil, fmt.Errorf("token file %s has no key derivation parameters", s.path)
+	}
+	if kdf.Algorithm != kdfAlgorithm || len(kdf.Salt) == 0 || kdf.N > scryptMaxN || kdf.R > scryptMaxR || kdf.P > scryptMaxP {
+		return nil, fmt.Errorf("token file %s has unsupported key derivation parameters", s.path)
+	}
+	key, err := scrypt.Key([]byte(s.passphrase), kdf.Salt, kdf.N, kdf.R, kdf.P, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive token key: %v", err)
+	}
+	return key, nil
+}
+
+// newCipher builds the AES-GCM cipher used for encrypted token files
+func newCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,126 @@
+package spotify
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// testExpiry is the expiry of testToken
+var testExpiry = time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// testToken returns a token with a recorded scope
+func testToken() *oauth2.Token {
+	tok := &oauth2.Token{AccessToken: "secret-access", RefreshToken: "secret-refresh", TokenType: "Bearer", Expiry: testExpiry}
+	return tok.WithExtra(map[string]interface{}{"scope": "playlist-read-private"})
+}
+
+func TestTokenStoreRoundTrip(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse"} {
+		path := filepath.Join(t.TempDir(), "tokens", "token.json")
+		store := NewTokenStore(path, passphrase)
+		if tok, err := store.Load(); tok != nil || err != nil {
+			t.Fatalf("expected no token before saving, got %v, %v", tok, err)
+		}
+
+		if err := store.Save(testToken()); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := store.Load()
+		if err != nil {
+			t.Fatalf("passphrase %q: %v", passphrase, err)
+		}
+		if tok.AccessToken != "secret-access" || tok.RefreshToken != "secret-refresh" || !tok.Expiry.Equal(testExpiry) || tokenScope(tok) != "playlist-read-private" {
+			t.Errorf("passphrase %q: unexpected token %+v with scope %q", passphrase, tok, tokenScope(tok))
+		}
+
+		// The token file is private, and an encrypted one holds no secrets in the clear
+		info, err := os.Stat(path)
+		if err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("passphrase %q: expected permissions 0600, got %v (%v)", passphrase, info.Mode().Perm(), err)
+		}
+		data, _ := os.ReadFile(path)
+		if encrypted := passphrase != ""; encrypted == strings.Contains(string(data), "secret-") {
+			t.Errorf("passphrase %q: unexpected token file contents %s", passphrase, data)
+		}
+	}
+}
+
+func TestTokenStoreEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	if err := NewTokenStore(path, "correct horse").Save(testToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each save derives its key with a new salt
+	first, _ := os.ReadFile(path)
+	if err := NewTokenStore(path, "correct horse").Save(testToken()); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := os.ReadFile(path)
+	var a, b storedToken
+	if json.Unmarshal(first, &a) != nil || json.Unmarshal(second, &b) != nil || a.KDF == nil || b.KDF == nil {
+		t.Fatalf("expected key derivation parameters in the file, got %s", second)
+	}
+	if a.KDF.Algorithm != "scrypt" || string(a.KDF.Salt) == string(b.KDF.Salt) {
+		t.Errorf("expected scrypt with a new salt per save, got %+v and %+v", a.KDF, b.KDF)
+	}
+
+	if _, err := NewTokenStore(path, "wrong horse").Load(); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("expected a wrong passphrase to fail, got %v", err)
+	}
+	if _, err := NewTokenStore(path, "").Load(); err == nil || !strings.Contains(err.Error(), "SPOTIFY_TOKEN_KEY") {
+		t.Errorf("expected a missing passphrase to fail, got %v", err)
+	}
+
+	// A tampered file is rejected, including one demanding an excessive key derivation cost
+	tampered := b
+	tampered.Data = append([]byte(nil), b.Data...)
+	tampered.Data[0] ^= 0xff
+	costly := b
+	costly.KDF = &kdfParams{Algorithm: "scrypt", Salt: b.KDF.Salt, N: 1 << 30, R: 8, P: 1}
+	for name, stored := range map[string]storedToken{"tampered ciphertext": tampered, "excessive cost": costly} {
+		data, _ := json.Marshal(stored)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewTokenStore(path, "correct horse").Load(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := os.WriteFile(path, []byte(`{"encrypted": tru`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenStore(path, "correct horse").Load(); err == nil || !strings.Contains(err.Error(), "parse") {
+		t.Errorf("expected a truncated file to fail, got %v", err)
+	}
+}
+
+func TestTokenStoreRequiresKeyDerivation(t *testing.T) {
+	// An encrypted file without key derivation parameters is never decrypted with an
+	// unsalted key, even if it was encrypted with one
+	path := filepath.Join(t.TempDir(), "token.json")
+	key := sha256.Sum256([]byte("correct horse"))
+	block, _ := aes.NewCipher(key[:])
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	plaintext, _ := json.Marshal(testToken())
+	data, _ := json.Marshal(storedToken{Encrypted: true, Nonce: nonce, Data: gcm.Seal(nil, nonce, plaintext, nil)})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if tok, err := NewTokenStore(path, "correct horse").Load(); err == nil || !strings.Contains(err.Error(), "no key derivation parameters") {
+		t.Errorf("expected the file to be rejected, got %v, %v", tok, err)
+	}
+}
@@ -0,0 +1,58 @@
+package spotify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultAPIURL is the Web API base URL used by the spotify library
+const defaultAPIURL = "https://api.spotify.com"
+
+// rewriteTransport sends Web API requests to a different base URL, such as a local
+// fake of the API. The spotify library does not allow changing its base URL.
+type rewriteTransport struct {
+	target *url.URL
+	base   http.RoundTripper
+}
+
+// newRewriteTransport creates a transport redirecting Web API requests to apiURL
+func newRewriteTransport(apiURL string) (*rewriteTransport, error) {
+	target, err := url.Parse(strings.TrimSuffix(apiURL, "/"))
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid API URL %q", apiURL)
+	}
+	return &rewriteTransport{target: target, base: http.DefaultTransport}, nil
+}
+
+// RoundTrip rewrites requests for the Web API host and passes everything else through
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme+"://"+req.URL.Host != defaultAPIURL {
+		return t.base.RoundTrip(req)
+	}
+
+	rewritten := req.Clone(req.Context())
+	rewritten.URL.Scheme = t.target.Scheme
+	rewritten.URL.Host = t.target.Host
+	rewritten.URL.Path = t.target.Path + req.URL.Path
+	rewritten.Host = t.target.Host
+	return t.base.RoundTrip(rewritten)
+}
+
+// contextTransport attaches a context to requests that don't carry one. The
+// spotify library creates its requests without a context, so this is what makes
+// in-flight API calls stop when a run is cancelled.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+// RoundTrip sends the request bound to the transport's context
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context() == context.Background() {
+		req = req.WithContext(t.ctx)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,387 @@
+// Package spotifytest provides a local fake of the Spotify Web API and Accounts
+// service for tests. It serves the endpoints used by this tool from JSON fixtures.
+package spotifytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tokens issued by the fake token endpoint
+const (
+	AccessToken  = "test-access-token"
+	RefreshToken = "test-refresh-token"
+)
+
+// GrantedScope is the default scope of the tokens issued by the fake token endpoint:
+// every permission the program can request
+const GrantedScope = "playlist-read-private playlist-read-collaborative user-library-read user-top-read user-read-recently-played"
+
+// Fixture holds the data served by the fake API. Playlists and tracks are kept
+// as raw JSON so fixtures can contain anything the real API returns.
+type Fixture struct {
+	User      json.RawMessage              `json:"user"`
+	Playlists []json.RawMessage            `json:"playlists"`
+	Tracks    map[string][]json.RawMessage `json:"tracks"`
+	// Catalog holds tracks that are only found by searching, such as other releases of playlist tracks
+	Catalog []json.RawMessage `json:"catalog"`
+	// SavedTracks and SavedAlbums are the items of the user's Liked Songs and saved albums
+	SavedTracks []json.RawMessage `json:"saved_tracks"`
+	SavedAlbums []json.RawMessage `json:"saved_albums"`
+	// AlbumTracks holds every track of the saved albums by album ID
+	AlbumTracks map[string][]json.RawMessage `json:"album_tracks"`
+	// TopTracks holds Spotify's top tracks by time range ("short_term", "medium_term"
+	// or "long_term") and RecentlyPlayed the recently played items, most recent first
+	TopTracks      map[string][]json.RawMessage `json:"top_tracks"`
+	RecentlyPlayed []json.RawMessage            `json:"recently_played"`
+}
+
+// LoadFixture reads a fixture from a JSON file
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %v", err)
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %s: %v", path, err)
+	}
+	return &fixture, nil
+}
+
+// failure describes simulated error responses for a path
+type failure struct {
+	remaining  int
+	status     int
+	retryAfter int
+}
+
+// Server is a fake Spotify API backed by an httptest.Server. API endpoints are
+// served under /v1 and the token endpoint under /api/token, so the server URL can
+// be used as both the API and the Accounts service base URL.
+type Server struct {
+	*httptest.Server
+	fixture *Fixture
+	// Scope is the space-separated list of permissions granted with each token
+	Scope string
+
+	mu       sync.Mutex
+	requests map[string]int
+	failures map[string]*failure
+}
+
+// NewServer starts a fake API serving the fixture
+func NewServer(fixture *Fixture) *Server {
+	s := &Server{
+		fixture:  fixture,
+		Scope:    GrantedScope,
+		requests: make(map[string]int),
+		failures: make(map[string]*failure),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/token", s.handleToken)
+	mux.HandleFunc("/v1/me", s.authorized(s.handleMe))
+	mux.HandleFunc("/v1/me/playlists", s.authorized(s.handlePlaylists))
+	mux.HandleFunc("/v1/playlists/", s.authorized(s.handlePlaylistTracks))
+	mux.HandleFunc("/v1/search", s.authorized(s.handleSearch))
+	mux.HandleFunc("/v1/me/tracks", s.authorized(s.handleSavedTracks))
+	mux.HandleFunc("/v1/me/albums", s.authorized(s.handleSavedAlbums))
+	mux.HandleFunc("/v1/albums/", s.authorized(s.handleAlbumTracks))
+	mux.HandleFunc("/v1/me/top/tracks", s.authorized(s.handleTopTracks))
+	mux.HandleFunc("/v1/me/player/recently-played", s.authorized(s.handleRecentlyPlayed))
+	mux.HandleFunc("/v1/tracks", s.authorized(s.handleTracks))
+
+	s.Server = httptest.NewServer(s.count(mux))
+	return s
+}
+
+// RateLimit makes the next n requests to path fail with 429 Too Many Requests
+// and the given Retry-After value in seconds
+func (s *Server) RateLimit(path string, n, retryAfter int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure{remaining: n, status: http.StatusTooManyRequests, retryAfter: retryAfter}
+}
+
+// Fail makes the next n requests to path fail with the given status. A negative
+// n makes every request fail.
+func (s *Server) Fail(path string, n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = &failure{remaining: n, status: status}
+}
+
+// Requests returns the number of requests received for path, including rate limited ones
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// count records each request and applies simulated failures
+func (s *Server) count(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		f := s.failures[r.URL.Path]
+		failing := f != nil && f.remaining != 0
+		if failing && f.remaining > 0 {
+			f.remaining--
+		}
+		s.mu.Unlock()
+
+		switch {
+		case !failing:
+			next.ServeHTTP(w, r)
+		case f.status == http.StatusTooManyRequests:
+			w.Header().Set("Retry-After", strconv.Itoa(f.retryAfter))
+			writeError(w, f.status, "API rate limit exceeded")
+		default:
+			writeError(w, f.status, http.StatusText(f.status))
+		}
+	})
+}
+
+// authorized rejects requests without the access token issued by the fake token endpoint
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+			writeError(w, http.StatusUnauthorized, "Invalid access token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleToken issues tokens for the authorization code and refresh token grants
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		if r.PostForm.Get("code") == "" {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != RefreshToken {
+			writeTokenError(w, "invalid_grant")
+			return
+		}
+	default:
+		writeTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"access_token":  AccessToken,
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+		"refresh_token": RefreshToken,
+		"scope":         s.Scope,
+	})
+}
+
+// handleMe serves the current user's profile
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.fixture.User)
+}
+
+// handlePlaylists serves the current user's playlists
+func (s *Server) handlePlaylists(w http.ResponseWriter, r *http.Request) {
+	s.writePage(w, r, s.fixture.Playlists, 20)
+}
+
+// handlePlaylistTracks serves /v1/playlists/{id}/tracks
+func (s *Server) handlePlaylistTracks(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/playlists/"), "/")
+	if len(parts) != 2 || parts[1] != "tracks" {
+		writeError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+	items, exists := s.fixture.Tracks[parts[0]]
+	if !exists {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	s.writePage(w, r, items, 100)
+}
+
+// handleSearch serves track searches by ISRC ("isrc:CODE"), over the playlist
+// tracks and the catalog
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	isrc, ok := strings.CutPrefix(r.URL.Query().Get("q"), "isrc:")
+	if !ok || r.URL.Query().Get("type") != "track" {
+		writeError(w, http.StatusBadRequest, "Unsupported search")
+		return
+	}
+
+	var found []json.RawMessage
+	seen := make(map[string]bool)
+	for _, raw := range s.tracks() {
+		var track struct {
+			ID          string            `json:"id"`
+			ExternalIDs map[string]string `json:"external_ids"`
+		}
+		if json.Unmarshal(raw, &track) != nil || !strings.EqualFold(track.ExternalIDs["isrc"], isrc) || seen[track.ID] {
+			continue
+		}
+		seen[track.ID] = true
+		found = append(found, raw)
+	}
+	writeJSON(w, map[string]interface{}{"tracks": s.page(r, found, 20)})
+}
+
+// handleSavedTracks serves the user's Liked Songs
+func (s *Server) handleSavedTracks(w http.ResponseWriter, r *http.Request) {
+	s.writePage(w, r, s.fixture.SavedTracks, 20)
+}
+
+// handleSavedAlbums serves the user's saved albums
+func (s *Server) handleSavedAlbums(w http.ResponseWriter, r *http.Request) {
+	s.writePage(w, r, s.fixture.SavedAlbums, 20)
+}
+
+// handleAlbumTracks serves /v1/albums/{id}/tracks
+func (s *Server) handleAlbumTracks(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/albums/"), "/")
+	if len(parts) != 2 || parts[1] != "tracks" {
+		writeError(w, http.StatusNotFound, "Service not found")
+		return
+	}
+	tracks, exists := s.fixture.AlbumTracks[parts[0]]
+	if !exists {
+		writeError(w, http.StatusNotFound, "Not found.")
+		return
+	}
+	s.writePage(w, r, tracks, 20)
+}
+
+// handleTopTracks serves Spotify's top tracks for the time_range parameter
+func (s *Server) handleTopTracks(w http.ResponseWriter, r *http.Request) {
+	timeRange := r.URL.Query().Get("time_range")
+	if timeRange == "" {
+		timeRange = "medium_term"
+	}
+	s.writePage(w, r, s.fixture.TopTracks[timeRange], 20)
+}
+
+// handleRecentlyPlayed serves the recently played items
+func (s *Server) handleRecentlyPlayed(w http.ResponseWriter, r *http.Request) {
+	s.writePage(w, r, s.fixture.RecentlyPlayed, 20)
+}
+
+// handleTracks serves /v1/tracks?ids=..., with null for unknown IDs
+func (s *Server) handleTracks(w http.ResponseWriter, r *http.Request) {
+	byID := make(map[string]json.RawMessage)
+	for _, raw := range s.tracks() {
+		var track struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &track) == nil && track.ID != "" {
+			byID[track.ID] = raw
+		}
+	}
+
+	var found []json.RawMessage
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if raw, exists := byID[id]; exists {
+			found = append(found, raw)
+		} else {
+			found = append(found, json.RawMessage("null"))
+		}
+	}
+	writeJSON(w, map[string]interface{}{"tracks": found})
+}
+
+// tracks returns every full track in the fixture: the playlist tracks, the catalog
+// and Spotify's top tracks
+func (s *Server) tracks() []json.RawMessage {
+	var tracks []json.RawMessage
+	for _, items := range s.fixture.Tracks {
+		for _, item := range items {
+			var playlistTrack struct {
+				Track json.RawMessage `json:"track"`
+			}
+			if json.Unmarshal(item, &playlistTrack) == nil && playlistTrack.Track != nil {
+				tracks = append(tracks, playlistTrack.Track)
+			}
+		}
+	}
+	tracks = append(tracks, s.fixture.Catalog...)
+	for _, items := range s.fixture.TopTracks {
+		tracks = append(tracks, items...)
+	}
+	return tracks
+}
+
+// writePage writes a paging object for the items selected by the limit and offset parameters
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []json.RawMessage, defaultLimit int) {
+	writeJSON(w, s.page(r, items, defaultLimit))
+}
+
+// page returns a paging object for the items selected by the limit and offset parameters
+func (s *Server) page(r *http.Request, items []json.RawMessage, defaultLimit int) map[string]interface{} {
+	limit, offset := defaultLimit, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, _ = strconv.Atoi(v)
+	}
+	if offset > len(items) {
+		offset = len(items)
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := map[string]interface{}{
+		"href":   s.URL + r.URL.Path,
+		"limit":  limit,
+		"offset": offset,
+		"total":  len(items),
+		"items":  items[offset:end],
+	}
+	if end < len(items) {
+		page["next"] = fmt.Sprintf("%s%s?offset=%d&limit=%d", s.URL, r.URL.Path, end, limit)
+	}
+	return page
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in the Web API's error format
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"status": status, "message": message},
+	})
+}
+
+// writeTokenError writes an error in the Accounts service's OAuth error format
+func writeTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
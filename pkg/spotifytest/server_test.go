@@ -0,0 +1,143 @@
+package spotifytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestServer starts a server with the package's test fixture
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	fixture, err := LoadFixture("testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(fixture)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get performs an authorized GET request and decodes the JSON response
+func get(t *testing.T, server *Server, path string, result interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+// page is the subset of a paging object checked by the tests
+type page struct {
+	Total int               `json:"total"`
+	Next  string            `json:"next"`
+	Items []json.RawMessage `json:"items"`
+}
+
+func TestPagination(t *testing.T) {
+	server := newTestServer(t)
+
+	var first page
+	get(t, server, "/v1/playlists/pl-1/tracks?limit=2&offset=0", &first)
+	if first.Total != 3 || len(first.Items) != 2 || first.Next == "" {
+		t.Fatalf("unexpected first page: total=%d items=%d next=%q", first.Total, len(first.Items), first.Next)
+	}
+
+	var second page
+	get(t, server, "/v1/playlists/pl-1/tracks?limit=2&offset=2", &second)
+	if len(second.Items) != 1 || second.Next != "" {
+		t.Fatalf("unexpected second page: items=%d next=%q", len(second.Items), second.Next)
+	}
+
+	var playlists page
+	get(t, server, "/v1/me/playlists?limit=50", &playlists)
+	if playlists.Total != 3 || len(playlists.Items) != 3 {
+		t.Fatalf("unexpected playlists page: total=%d items=%d", playlists.Total, len(playlists.Items))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := newTestServer(t)
+	server.RateLimit("/v1/me", 2, 3)
+
+	for i := 0; i < 2; i++ {
+		resp := get(t, server, "/v1/me", nil)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("request %d: expected 429, got %d", i+1, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "3" {
+			t.Fatalf("expected Retry-After 3, got %q", got)
+		}
+	}
+
+	var user struct {
+		ID string `json:"id"`
+	}
+	if resp := get(t, server, "/v1/me", &user); resp.StatusCode != http.StatusOK || user.ID != "testuser" {
+		t.Fatalf("expected user after rate limit, got status %d id %q", resp.StatusCode, user.ID)
+	}
+	if got := server.Requests("/v1/me"); got != 3 {
+		t.Fatalf("expected 3 requests, got %d", got)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server := newTestServer(t)
+	resp, err := http.Get(server.URL + "/v1/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestToken(t *testing.T) {
+	server := newTestServer(t)
+
+	tests := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}}, http.StatusOK},
+		{url.Values{"grant_type": {"refresh_token"}, "refresh_token": {RefreshToken}}, http.StatusOK},
+		{url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"revoked"}}, http.StatusBadRequest},
+		{url.Values{"grant_type": {"client_credentials"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(server.URL+"/api/token", "application/x-www-form-urlencoded", strings.NewReader(tt.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: expected %d, got %d", tt.form, tt.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestFail(t *testing.T) {
+	server := newTestServer(t)
+	server.Fail("/v1/me", -1, http.StatusServiceUnavailable)
+
+	for i := 0; i < 3; i++ {
+		if resp := get(t, server, "/v1/me", nil); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: expected 503, got %d", i+1, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package streaming reads the listening history in Spotify's privacy data export.
+// The export comes in two formats: the account data, whose StreamingHistory*.json
+// files cover the last year and identify tracks by name only, and the extended
+// streaming history, whose Streaming_History_Audio_*.json files cover the whole
+// life of the account and include each track's Spotify URI. Plays are counted per
+// track and calendar year, entirely from the local files.
+package streaming
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+)
+
+// MinPlayDuration is how long a track must play to count as a play, the same
+// threshold Spotify uses for its own stream counts. Shorter plays, such as skips,
+// still add to the time played.
+const MinPlayDuration = 30 * time.Second
+
+// trackURIPrefix starts the Spotify URI of a track in the extended streaming history
+const trackURIPrefix = "spotify:track:"
+
+// Stats are the plays of a track
+type Stats struct {
+	Plays    int
+	MsPlayed int64
+}
+
+// Minutes returns the time played in minutes
+func (s Stats) Minutes() float64 {
+	return float64(s.MsPlayed) / float64(time.Minute/time.Millisecond)
+}
+
+// History holds the plays of each track per calendar year
+type History struct {
+	// plays holds the plays of every track by its normalized title and artist
+	plays map[string]map[int]*Stats
+	// names holds the keys in plays that each track ID of the extended streaming
+	// history was played under
+	names map[string]map[string]bool
+	// Files and Streams count the files read and the streams found in them
+	Files   int
+	Streams int
+}
+
+// stream is a single stream from either format of the export
+type stream struct {
+	// Account data
+	EndTime    string `json:"endTime"`
+	ArtistName string `json:"artistName"`
+	TrackName  string `json:"trackName"`
+	MsPlayed   int64  `json:"msPlayed"`
+
+	// Extended streaming history
+	Timestamp   string `json:"ts"`
+	ExtMsPlayed int64  `json:"ms_played"`
+	ExtTrack    string `json:"master_metadata_track_name"`
+	ExtArtist   string `json:"master_metadata_album_artist_name"`
+	TrackURI    string `json:"spotify_track_uri"`
+}
+
+// Load reads the streaming history files in dir and its subdirectories. The
+// extended streaming history includes everything in the account data, so when
+// both are present only the extended history is read. Podcast and video streams
+// are left out.
+func Load(dir string) (*History, error) {
+	var basic, extended []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() || !strings.EqualFold(filepath.Ext(name), ".json") {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(name, "StreamingHistory"):
+			basic = append(basic, path)
+		case strings.HasPrefix(name, "Streaming_History_Audio_"), strings.HasPrefix(name, "endsong"):
+			extended = append(extended, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read streaming history directory: %v", err)
+	}
+	if len(basic) == 0 && len(extended) == 0 {
+		return nil, fmt.Errorf("no streaming history files found in %s", dir)
+	}
+
+	history := &History{
+		plays: make(map[string]map[int]*Stats),
+		names: make(map[string]map[string]bool),
+	}
+	files := extended
+	if len(files) == 0 {
+		files = basic
+	}
+	for _, path := range files {
+		if err := history.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// readFile adds the streams of a history file
+func (h *History) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read streaming history %s: %v", path, err)
+	}
+	var streams []stream
+	if err := json.Unmarshal(data, &streams); err != nil {
+		return fmt.Errorf("failed to parse streaming history %s: %v", path, err)
+	}
+
+	for i, s := range streams {
+		title, artist, ms := s.TrackName, s.ArtistName, s.MsPlayed
+		var ended time.Time
+		if s.Timestamp != "" {
+			title, artist, ms = s.ExtTrack, s.ExtArtist, s.ExtMsPlayed
+			ended, err = time.Parse(time.RFC3339, s.Timestamp)
+		} else {
+			ended, err = time.Parse("2006-01-02 15:04", s.EndTime)
+		}
+		// Podcast episodes and videos have no track name
+		if title == "" {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid time of stream %d in %s: %v", i+1, path, err)
+		}
+
+		// Each stream is recorded once, under its name; a stream whose name leaves no
+		// key after normalization is recorded under its URI
+		key := nameKey(title, artist)
+		id := strings.TrimPrefix(s.TrackURI, trackURIPrefix)
+		if id == s.TrackURI {
+			id = ""
+		}
+		if key == "" && id != "" {
+			key = s.TrackURI
+		}
+		if key != "" {
+			add(h.plays, key, ended.Year(), ms)
+		}
+		if id != "" && key != "" {
+			if h.names[id] == nil {
+				h.names[id] = make(map[string]bool)
+			}
+			h.names[id][key] = true
+		}
+		h.Streams++
+	}
+	h.Files++
+	return nil
+}
+
+// add records a stream of ms milliseconds under a key and year
+func add(plays map[string]map[int]*Stats, key string, year int, ms int64) {
+	if plays[key] == nil {
+		plays[key] = make(map[int]*Stats)
+	}
+	stats := plays[key][year]
+	if stats == nil {
+		stats = &Stats{}
+		plays[key][year] = stats
+	}
+	if time.Duration(ms)*time.Millisecond >= MinPlayDuration {
+		stats.Plays++
+	}
+	stats.MsPlayed += ms
+}
+
+// nameKey returns the key of a track by its title and primary artist, ignoring case,
+// punctuation and version suffixes the same way top tracks matching does
+func nameKey(title, artist string) string {
+	return match.Key(match.StrategyTitleArtist, match.Track{Title: title, Artists: []string{artist}})
+}
+
+// Lookup returns the plays of a track in a year, or in all years if year is 0. A
+// track is found by its title and primary artist, which also finds plays of other
+// releases of the song, and by its ID in the extended streaming history, which finds
+// plays listed under another title or artist, such as a renamed track. Each stream
+// counts once even if it is found both ways.
+func (h *History) Lookup(track match.Track, year int) Stats {
+	keys := make(map[string]bool)
+	if len(track.Artists) > 0 {
+		if key := nameKey(track.Title, track.Artists[0]); key != "" {
+			keys[key] = true
+		}
+	}
+	if track.ID != "" {
+		for key := range h.names[track.ID] {
+			keys[key] = true
+		}
+	}
+
+	var total Stats
+	for key := range keys {
+		for y, stats := range h.plays[key] {
+			if year == 0 || y == year {
+				total.Plays += stats.Plays
+				total.MsPlayed += stats.MsPlayed
+			}
+		}
+	}
+	return total
+}
+
+// Tracks returns the number of distinct tracks played
+func (h *History) Tracks() int {
+	return len(h.plays)
+}
@@ -0,0 +1,105 @@
+package streaming
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mikev/spotify-analysis/pkg/match"
+)
+
+// writeFile writes a history file below dir
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadAccountData(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "Spotify Account Data/StreamingHistory_music_0.json", `[
+		{"endTime": "2021-12-31 23:50", "artistName": "Alpha", "trackName": "Golden Hour", "msPlayed": 200000},
+		{"endTime": "2022-01-01 00:10", "artistName": "Alpha", "trackName": "Golden Hour - 2021 Remaster", "msPlayed": 180000},
+		{"endTime": "2022-01-02 10:00", "artistName": "Alpha", "trackName": "Golden Hour", "msPlayed": 5000}
+	]`)
+	writeFile(t, dir, "Spotify Account Data/StreamingHistory_podcast_0.json", `[
+		{"endTime": "2022-01-03 10:00", "podcastName": "Stories", "episodeName": "Pilot", "msPlayed": 900000}
+	]`)
+	writeFile(t, dir, "Spotify Account Data/Userdata.json", `{"username": "me"}`)
+
+	history, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if history.Files != 2 || history.Streams != 3 || history.Tracks() != 1 {
+		t.Errorf("expected 3 streams of 1 track in 2 files, got %d of %d in %d", history.Streams, history.Tracks(), history.Files)
+	}
+
+	// The remaster is the same song; the 5 second skip adds time but no play
+	track := match.Track{ID: "t1", Title: "Golden Hour", Artists: []string{"Alpha", "Beta"}}
+	if got := history.Lookup(track, 0); got.Plays != 2 || got.MsPlayed != 385000 {
+		t.Errorf("unexpected total: %+v", got)
+	}
+	if got := history.Lookup(track, 2022); got.Plays != 1 || got.MsPlayed != 185000 {
+		t.Errorf("unexpected 2022 plays: %+v", got)
+	}
+	if got := history.Lookup(match.Track{Title: "Night Drive", Artists: []string{"Beta"}}, 0); got != (Stats{}) {
+		t.Errorf("expected no plays of an unknown track, got %+v", got)
+	}
+}
+
+func TestLoadExtendedHistory(t *testing.T) {
+	dir := t.TempDir()
+	// The account data is ignored when the extended history is present
+	writeFile(t, dir, "StreamingHistory_music_0.json", `[
+		{"endTime": "2023-01-01 10:00", "artistName": "Alpha", "trackName": "Golden Hour", "msPlayed": 200000}
+	]`)
+	writeFile(t, dir, "Streaming_History_Audio_2021-2023_0.json", `[
+		{"ts": "2021-06-01T10:00:00Z", "ms_played": 60000, "master_metadata_track_name": "Golden Hour", "master_metadata_album_artist_name": "Alpha", "spotify_track_uri": "spotify:track:t1"},
+		{"ts": "2022-06-01T10:00:00Z", "ms_played": 60000, "master_metadata_track_name": "Golden Hour", "master_metadata_album_artist_name": "Alpha", "spotify_track_uri": "spotify:track:t9"},
+		{"ts": "2023-02-01T10:00:00Z", "ms_played": 90000, "master_metadata_track_name": "Golden Hour (Live)", "master_metadata_album_artist_name": "Various Artists", "spotify_track_uri": "spotify:track:t1"},
+		{"ts": "2022-07-01T10:00:00Z", "ms_played": 1200000, "master_metadata_track_name": null, "spotify_track_uri": null, "spotify_episode_uri": "spotify:episode:e1"}
+	]`)
+
+	history, err := Load(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if history.Files != 1 || history.Streams != 3 {
+		t.Errorf("expected 3 streams in 1 file, got %d in %d", history.Streams, history.Files)
+	}
+
+	// Other releases are found by name, and plays under another name by the track ID;
+	// streams found both ways count once
+	tests := []struct {
+		name    string
+		track   match.Track
+		year    int
+		plays   int
+		minutes float64
+	}{
+		{"by name and ID", match.Track{ID: "t1", Title: "Golden Hour", Artists: []string{"Alpha"}}, 0, 3, 3.5},
+		{"by name and ID in a year", match.Track{ID: "t1", Title: "Golden Hour", Artists: []string{"Alpha"}}, 2023, 1, 1.5},
+		{"by name only", match.Track{ID: "t2", Title: "Golden Hour", Artists: []string{"Alpha"}}, 0, 2, 2},
+		{"by ID only", match.Track{ID: "t1"}, 0, 3, 3.5},
+		{"unknown track", match.Track{ID: "t3", Title: "Night Drive", Artists: []string{"Beta"}}, 0, 0, 0},
+	}
+	for _, test := range tests {
+		if got := history.Lookup(test.track, test.year); got.Plays != test.plays || got.Minutes() != test.minutes {
+			t.Errorf("%s: expected %d plays in %v minutes, got %+v", test.name, test.plays, test.minutes, got)
+		}
+	}
+
+	writeFile(t, dir, "Streaming_History_Audio_2024_1.json", `[{"ts": "yesterday", "ms_played": 1, "master_metadata_track_name": "x"}]`)
+	if _, err := Load(dir); err == nil {
+		t.Error("expected an invalid timestamp to be rejected")
+	}
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected an error for a directory without history files")
+	}
+}
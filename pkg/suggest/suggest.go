@@ -0,0 +1,119 @@
+// Package suggest ranks the tracks missing from a year's top tracks playlist by how
+// likely they are to belong in it, so curating the playlist becomes a review of the
+// best candidates instead of a search through every marked track. Each candidate is
+// scored from signals about how much it was listened to: how many playlists contain
+// it, how soon after its release it was added, how often it was played and whether
+// its artist already made the year's top tracks playlist.
+package suggest
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Weights of the signals in the score. The play count is the most direct measure
+// of listening, so it weighs most when a streaming history is imported.
+const (
+	PlaylistsWeight = 3.0
+	AddedWeight     = 1.0
+	PlaysWeight     = 4.0
+	ArtistWeight    = 2.0
+)
+
+// Candidate is a track missing from the top tracks playlist of its release year
+type Candidate struct {
+	TrackID     string
+	TrackName   string
+	Artists     string
+	Album       string
+	ReleaseYear string
+	// Playlists names the playlists containing the track
+	Playlists []string
+	// FirstAdded is when the track was first added to one of them, or zero if unknown
+	FirstAdded time.Time
+	// Plays counts the track's plays in its release year in the imported streaming history
+	Plays int
+	// ArtistInTopTracks reports whether one of the track's artists is in the
+	// top tracks playlist of its release year
+	ArtistInTopTracks bool
+}
+
+// Suggestion is a scored candidate and its rank within its release year
+type Suggestion struct {
+	Candidate
+	Rank int
+	// Score is the weighted average of the signals, from 0 to 100
+	Score float64
+}
+
+// Rank scores the candidates and returns them by release year, best first. The
+// playlist and play counts are scaled against the highest count of the year. Play
+// counts only take part when withPlays is set, since without an imported history
+// every track would count as never played.
+func Rank(candidates []Candidate, withPlays bool) map[string][]Suggestion {
+	byYear := make(map[string][]Candidate)
+	for _, candidate := range candidates {
+		byYear[candidate.ReleaseYear] = append(byYear[candidate.ReleaseYear], candidate)
+	}
+
+	ranked := make(map[string][]Suggestion)
+	for year, list := range byYear {
+		maxPlaylists, maxPlays := 0, 0
+		for _, candidate := range list {
+			maxPlaylists = max(maxPlaylists, len(candidate.Playlists))
+			maxPlays = max(maxPlays, candidate.Plays)
+		}
+
+		suggestions := make([]Suggestion, 0, len(list))
+		for _, candidate := range list {
+			score := PlaylistsWeight*ratio(len(candidate.Playlists), maxPlaylists) +
+				AddedWeight*addedSignal(candidate)
+			weights := PlaylistsWeight + AddedWeight + ArtistWeight
+			if candidate.ArtistInTopTracks {
+				score += ArtistWeight
+			}
+			if withPlays {
+				score += PlaysWeight * ratio(candidate.Plays, maxPlays)
+				weights += PlaysWeight
+			}
+			suggestions = append(suggestions, Suggestion{Candidate: candidate, Score: 100 * score / weights})
+		}
+
+		// Ties go to the track in more playlists, then the one added first
+		sort.SliceStable(suggestions, func(i, j int) bool {
+			a, b := suggestions[i], suggestions[j]
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			if len(a.Playlists) != len(b.Playlists) {
+				return len(a.Playlists) > len(b.Playlists)
+			}
+			return !a.FirstAdded.IsZero() && (b.FirstAdded.IsZero() || a.FirstAdded.Before(b.FirstAdded))
+		})
+		for i := range suggestions {
+			suggestions[i].Rank = i + 1
+		}
+		ranked[year] = suggestions
+	}
+	return ranked
+}
+
+// ratio scales a count against the highest count, from 0 to 1
+func ratio(count, highest int) float64 {
+	if highest == 0 {
+		return 0
+	}
+	return float64(count) / float64(highest)
+}
+
+// addedSignal is 1 for a track first added in its release year, and halves, thirds
+// and so on for each year it took to be added. A track added before its release
+// year, such as a pre-save, counts as added in it.
+func addedSignal(candidate Candidate) float64 {
+	year, err := strconv.Atoi(candidate.ReleaseYear)
+	if candidate.FirstAdded.IsZero() || err != nil {
+		return 0
+	}
+	return 1 / float64(1+max(candidate.FirstAdded.Year()-year, 0))
+}
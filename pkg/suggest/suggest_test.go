@@ -0,0 +1,44 @@
+package suggest
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRank(t *testing.T) {
+	added := func(year int) time.Time { return time.Date(year, 6, 1, 0, 0, 0, 0, time.UTC) }
+	candidates := []Candidate{
+		{TrackID: "a", ReleaseYear: "2021", Playlists: []string{"P1"}, FirstAdded: added(2022), Plays: 10},
+		{TrackID: "b", ReleaseYear: "2021", Playlists: []string{"P1", "P2"}, FirstAdded: added(2021), Plays: 0, ArtistInTopTracks: true},
+		{TrackID: "c", ReleaseYear: "2021", Playlists: []string{"P2"}, FirstAdded: added(2021), Plays: 20},
+		{TrackID: "d", ReleaseYear: "2022", Playlists: []string{"P1"}},
+	}
+
+	// Without plays: a = (3*0.5 + 1*0.5) / 6, b = (3 + 1 + 2) / 6, c = (3*0.5 + 1) / 6
+	ranked := Rank(candidates, false)
+	assertRanking(t, ranked["2021"], []string{"b", "c", "a"}, []float64{100, 100 * 2.5 / 6, 100 * 2.0 / 6})
+
+	// With plays: a = (2 + 4*0.5) / 10, b = 6 / 10, c = (2.5 + 4) / 10
+	ranked = Rank(candidates, true)
+	assertRanking(t, ranked["2021"], []string{"c", "b", "a"}, []float64{65, 60, 40})
+
+	// Each year is ranked on its own
+	if year := ranked["2022"]; len(year) != 1 || year[0].Rank != 1 || year[0].Score != 30 {
+		t.Errorf("unexpected 2022 suggestions: %+v", year)
+	}
+}
+
+// assertRanking checks the order and scores of a year's suggestions
+func assertRanking(t *testing.T, suggestions []Suggestion, ids []string, scores []float64) {
+	t.Helper()
+	if len(suggestions) != len(ids) {
+		t.Fatalf("expected %d suggestions, got %d", len(ids), len(suggestions))
+	}
+	for i, suggestion := range suggestions {
+		if suggestion.TrackID != ids[i] || suggestion.Rank != i+1 || math.Abs(suggestion.Score-scores[i]) > 1e-9 {
+			t.Errorf("suggestion %d: expected %s with score %.2f, got %s ranked %d with %.2f",
+				i+1, ids[i], scores[i], suggestion.TrackID, suggestion.Rank, suggestion.Score)
+		}
+	}
+}